@@ -1,24 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 )
 
-func SendInsertNodeCommand(mainAddr string, ip_address string, replica_count string) {
+// postAdminForm posts form data to the master with the token from the
+// ADMIN_TOKEN environment variable
+func postAdminForm(endpoint string, data url.Values) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ADMIN_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func SendInsertNodeCommand(mainAddr string, id string, addr string, replica_count string) {
 	// Construct the URL for the heartbeat endpoint
 	endpoint := fmt.Sprintf("http://%s/insert", mainAddr)
 
 	// Construct the POST data: empty data
 	postData := url.Values{}
-	postData.Set("ip_address", ip_address)
+	postData.Set("id", id)
+	postData.Set("addr", addr)
 	postData.Set("replica_count", replica_count)
 
-	// Send heartbeat POST request to master
-	_, err := http.PostForm(endpoint, postData)
+	// Send insert POST request to master
+	err := postAdminForm(endpoint, postData)
 	if err != nil {
 		log.Println("Error sending insert:", err)
 	} else {
@@ -26,7 +53,7 @@ func SendInsertNodeCommand(mainAddr string, ip_address string, replica_count str
 	}
 }
 
-func SendRemoveNodeCommand(mainAddr string, ip_address string) {
+func SendRemoveNodeCommand(mainAddr string, id string) {
 	// Just in case we want to remove a given node immediately
 
 	// Construct the URL for the heartbeat endpoint
@@ -34,10 +61,10 @@ func SendRemoveNodeCommand(mainAddr string, ip_address string) {
 
 	// Construct the POST data: empty data
 	postData := url.Values{}
-	postData.Set("ip_address", ip_address)
+	postData.Set("id", id)
 
-	// Send heartbeat POST request to master
-	_, err := http.PostForm(endpoint, postData)
+	// Send delete POST request to master
+	err := postAdminForm(endpoint, postData)
 	if err != nil {
 		log.Println("Error sending delete:", err)
 	} else {
@@ -45,13 +72,66 @@ func SendRemoveNodeCommand(mainAddr string, ip_address string) {
 	}
 }
 
+// SendAdminRequest calls the master's JSON admin API with the token from the
+// ADMIN_TOKEN environment variable and prints the response
+func SendAdminRequest(mainAddr string, method string, path string, body any) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			log.Fatalln("Error encoding request:", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", mainAddr, path), reader)
+	if err != nil {
+		log.Fatalln("Error creating request:", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ADMIN_TOKEN"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalln("Error sending request:", err)
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Request failed: %s: %s", resp.Status, response)
+	}
+	fmt.Print(string(response))
+}
+
 func main() {
-	// Master address
+	// Master address, MAIN_ADDR picks one of several replicated routers.
+	// Followers redirect changes to the leader.
 	masterAddr := "localhost:8080"
+	if addr := os.Getenv("MAIN_ADDR"); addr != "" {
+		masterAddr = addr
+	}
 
 	if os.Args[1] == "insert" {
-		SendInsertNodeCommand(masterAddr, os.Args[2], os.Args[3])
+		SendInsertNodeCommand(masterAddr, os.Args[2], os.Args[3], os.Args[4])
 	} else if os.Args[1] == "remove" {
 		SendRemoveNodeCommand(masterAddr, os.Args[2])
+	} else if os.Args[1] == "list" {
+		SendAdminRequest(masterAddr, http.MethodGet, "/admin/nodes", nil)
+	} else if os.Args[1] == "get" {
+		SendAdminRequest(masterAddr, http.MethodGet, "/admin/nodes/"+url.PathEscape(os.Args[2]), nil)
+	} else if os.Args[1] == "weight" {
+		replicas, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			log.Fatalln("Error parsing replica count:", err)
+		}
+		SendAdminRequest(masterAddr, http.MethodPut, "/admin/nodes/"+url.PathEscape(os.Args[2])+"/weight", map[string]int{"replicas": replicas})
+	} else if os.Args[1] == "state" {
+		SendAdminRequest(masterAddr, http.MethodPut, "/admin/nodes/"+url.PathEscape(os.Args[2])+"/state", map[string]string{"state": os.Args[3]})
+	} else if os.Args[1] == "addr" {
+		SendAdminRequest(masterAddr, http.MethodPut, "/admin/nodes/"+url.PathEscape(os.Args[2])+"/addr", map[string]string{"addr": os.Args[3]})
+	} else if os.Args[1] == "ring" {
+		SendAdminRequest(masterAddr, http.MethodGet, "/admin/ring", nil)
 	}
 }
@@ -2,4 +2,4 @@
 source ~/.profile
 cd web_cache
 go mod tidy
-go run main.go
\ No newline at end of file
+go run .
\ No newline at end of file
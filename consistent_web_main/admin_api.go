@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+	"web_main/consistent_hash"
+)
+
+// nodeView is the JSON form of a node in the admin API
+type nodeView struct {
+	ID                  string      `json:"id"`
+	Addr                string      `json:"addr"`
+	Replicas            int         `json:"replicas"`
+	State               string      `json:"state"`
+	Namespace           string      `json:"namespace"`
+	Live                bool        `json:"live"`
+	LastHeartbeat       time.Time   `json:"last_heartbeat"`
+	HeartbeatAgeSeconds float64     `json:"heartbeat_age_seconds"`
+	Health              *NodeHealth `json:"health,omitempty"`
+	RingShare           float64     `json:"ring_share"`
+	ResponseTimeEWMA    *float64    `json:"response_time_ewma_seconds,omitempty"`
+}
+
+func (main Main) nodeView(node consistent_hash.ServerNode, shares map[string]float64) nodeView {
+	view := nodeView{
+		ID:                  node.ID,
+		Addr:                node.Addr,
+		Replicas:            node.Replicas,
+		State:               main.membership.State(node.ID),
+		Namespace:           main.membership.NamespaceOf(node.ID),
+		Live:                main.membership.Live(node, main.config.Load().HeartbeatTimeout),
+		LastHeartbeat:       node.Timestamp,
+		HeartbeatAgeSeconds: max(time.Since(node.Timestamp).Seconds(), 0),
+		RingShare:           shares[node.ID],
+	}
+	if health, ok := main.health.Get(node.ID); ok {
+		view.Health = &health
+	}
+	if t, ok := main.responseTimes.All()[node.ID]; ok {
+		seconds := t.EWMA.Seconds()
+		view.ResponseTimeEWMA = &seconds
+	}
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// processListNodes lists every known node with the current ring version
+func (main Main) processListNodes(w http.ResponseWriter, r *http.Request) {
+	shares := main.membership.RingShares()
+	nodes := make([]nodeView, 0)
+	for _, node := range main.membership.Nodes() {
+		nodes = append(nodes, main.nodeView(node, shares))
+	}
+	writeJSON(w, map[string]any{
+		"ring_version": main.membership.Stats().Version,
+		"nodes":        nodes,
+	})
+}
+
+// processGetNode describes the node named in the path
+func (main Main) processGetNode(w http.ResponseWriter, r *http.Request) {
+	node, ok := main.membership.Node(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, main.nodeView(node, main.membership.RingShares()))
+}
+
+// processSetWeight changes the number of virtual nodes of the node named in
+// the path, given as {"replicas": n} with an optional reason for the audit log
+func (main Main) processSetWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Replicas int    `json:"replicas"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Replicas <= 0 {
+		http.Error(w, "Body must be {\"replicas\": n} with n > 0", http.StatusBadRequest)
+		return
+	}
+	cmd := membershipCommand{Op: opWeight, ID: r.PathValue("id"), Replicas: body.Replicas, Actor: main.caller(r), Reason: body.Reason}
+	known, err := main.applyChange(cmd)
+	if err != nil {
+		main.changeError(w, r, err)
+		return
+	}
+	if !known {
+		http.Error(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+	main.processGetNode(w, r)
+}
+
+// processSetState drains the node named in the path or makes it active again,
+// given as {"state": "active"} or {"state": "draining"} with an optional reason
+func (main Main) processSetState(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		State  string `json:"state"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.State != NodeActive && body.State != NodeDraining) {
+		http.Error(w, "Body must be {\"state\": \"active\"} or {\"state\": \"draining\"}", http.StatusBadRequest)
+		return
+	}
+	cmd := membershipCommand{Op: opState, ID: r.PathValue("id"), State: body.State, Actor: main.caller(r), Reason: body.Reason}
+	known, err := main.applyChange(cmd)
+	if err != nil {
+		main.changeError(w, r, err)
+		return
+	}
+	if !known {
+		http.Error(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+	main.processGetNode(w, r)
+}
+
+// processSetAddr moves the node named in the path to a new advertised
+// address, given as {"addr": "host:port"} with an optional reason
+func (main Main) processSetAddr(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Addr   string `json:"addr"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !validNodeAddr(body.Addr) {
+		http.Error(w, "Body must be {\"addr\": \"host:port\"}", http.StatusBadRequest)
+		return
+	}
+	cmd := membershipCommand{Op: opAddress, ID: r.PathValue("id"), Addr: body.Addr, Actor: main.caller(r), Reason: body.Reason}
+	known, err := main.applyChange(cmd)
+	if err != nil {
+		main.changeError(w, r, err)
+		return
+	}
+	if !known {
+		http.Error(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+	main.processGetNode(w, r)
+}
+
+// processRing reports the ring version and size
+func (main Main) processRing(w http.ResponseWriter, r *http.Request) {
+	config := main.config.Load()
+	writeJSON(w, map[string]any{
+		"version":    main.membership.Stats().Version,
+		"algorithm":  config.RingAlgorithm,
+		"nodes":      len(main.membership.Nodes()),
+		"live_nodes": main.membership.LiveCount(config.HeartbeatTimeout),
+	})
+}
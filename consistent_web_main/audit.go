@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditInsert        = "insert"
+	AuditDelete        = "delete"
+	AuditExpire        = "expire"
+	AuditAddressChange = "address_change"
+	AuditSetWeight     = "set_weight"
+	AuditSetState      = "set_state"
+	AuditConfigReload  = "config_reload"
+	AuditAdminAccept   = "admin_call_accepted"
+	AuditAdminReject   = "admin_call_rejected"
+)
+
+// auditMemorySize is the number of recent records kept in memory for queries
+const auditMemorySize = 10000
+
+// Change identifies who made a membership change and why. Index is the Raft
+// log index of a replicated change and 0 otherwise.
+type Change struct {
+	Actor  string
+	Reason string
+	Index  uint64
+}
+
+// AuditRecord describes one membership or configuration change, or one admin
+// call
+type AuditRecord struct {
+	Time       time.Time      `json:"time"`
+	Action     string         `json:"action"`
+	Node       string         `json:"node,omitempty"`
+	Actor      string         `json:"actor"`
+	Reason     string         `json:"reason,omitempty"`
+	OldVersion uint64         `json:"old_version"`
+	NewVersion uint64         `json:"new_version"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// AuditLog appends audit records to a file as JSON lines, syncing after every
+// record, and keeps the most recent ones in memory for queries
+type AuditLog struct {
+	file    *os.File
+	records []AuditRecord
+	// raftIndex is the highest Raft log index recorded. Raft replays its log
+	// on restart and changes already in the file are not recorded again.
+	raftIndex uint64
+	logger    *zap.Logger
+	mutex     sync.Mutex
+}
+
+// OpenAuditLog loads the records already in path and appends new ones to it.
+// With an empty path records are only kept in memory.
+func OpenAuditLog(path string, logger *zap.Logger) (*AuditLog, error) {
+	audit := &AuditLog{logger: logger}
+	if path == "" {
+		return audit, nil
+	}
+
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A crash may leave a partial last line, which is skipped
+				continue
+			}
+			audit.append(record)
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading audit log: %v", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	audit.file = file
+	return audit, nil
+}
+
+func (a *AuditLog) append(record AuditRecord) {
+	// Indexes read back from the file are decoded as float64
+	switch index := record.Details["raft_index"].(type) {
+	case uint64:
+		a.raftIndex = max(a.raftIndex, index)
+	case float64:
+		a.raftIndex = max(a.raftIndex, uint64(index))
+	}
+	a.records = append(a.records, record)
+	if len(a.records) > auditMemorySize {
+		a.records = a.records[len(a.records)-auditMemorySize:]
+	}
+}
+
+// Record stores a change, stamping it with the current time
+func (a *AuditLog) Record(record AuditRecord) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if index, ok := record.Details["raft_index"].(uint64); ok && index <= a.raftIndex {
+		return
+	}
+	record.Time = time.Now()
+	a.append(record)
+	a.logger.Info("Audit", zap.String("action", record.Action), zap.String("node", record.Node),
+		zap.String("actor", record.Actor), zap.String("reason", record.Reason),
+		zap.Uint64("old_version", record.OldVersion), zap.Uint64("new_version", record.NewVersion))
+	if a.file == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = a.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		a.logger.Error("Error writing audit log", zap.Error(err))
+	}
+}
+
+// AuditQuery selects audit records. Empty fields match every record.
+type AuditQuery struct {
+	Node   string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+// Query returns the most recent records matching query, oldest first
+func (a *AuditLog) Query(query AuditQuery) []AuditRecord {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	matches := make([]AuditRecord, 0)
+	for i := len(a.records) - 1; i >= 0 && len(matches) < query.Limit; i-- {
+		record := a.records[i]
+		if (query.Node != "" && record.Node != query.Node) ||
+			(query.Action != "" && record.Action != query.Action) ||
+			record.Time.Before(query.Since) {
+			continue
+		}
+		matches = append(matches, record)
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+// configChanges returns the settings that differ between two configs by
+// their config file names. Token values are never included.
+func configChanges(old *Config, new *Config) []string {
+	changes := make([]string, 0)
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changes = append(changes, oldValue.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return changes
+}
+
+// caller returns the name of the authenticated caller of an admin request
+func (main Main) caller(r *http.Request) string {
+	name, _, _ := main.authenticate(r)
+	return name
+}
+
+// processAudit reports the most recent audit records, filtered by the optional
+// node, action and since (RFC 3339) query parameters, up to limit records
+func (main Main) processAudit(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := AuditQuery{Node: values.Get("node"), Action: values.Get("action"), Limit: 100}
+	if since := values.Get("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Error parsing since", http.StatusBadRequest)
+			return
+		}
+		query.Since = parsed
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Error parsing limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = parsed
+	}
+	writeJSON(w, map[string]any{"records": main.audit.Query(query)})
+}
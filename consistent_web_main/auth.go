@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Roles granted to admin callers. Read callers may inspect the cluster, admin
+// callers may also change it.
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+// authenticate identifies the caller from its bearer token or verified client
+// certificate. It returns the caller's name and role, or false if neither
+// matches the configuration.
+func (main Main) authenticate(r *http.Request) (string, string, bool) {
+	config := main.config.Load()
+	if provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && provided != "" {
+		// Every token is compared so the time taken does not reveal which one matched
+		name, role, matched := "", "", false
+		if config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(config.AdminToken)) == 1 {
+			name, role, matched = "admin_token", RoleAdmin, true
+		}
+		for _, token := range config.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token.Token)) == 1 && !matched {
+				name, role, matched = token.Name, token.Role, true
+			}
+		}
+		if matched {
+			return name, role, true
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, cert := range config.ClientCerts {
+			if cert.CommonName == commonName {
+				return "cert:" + commonName, cert.Role, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// authorize checks that the caller has at least the given role, responding
+// with 401 or 403 if not. Rejected calls and calls needing the admin role are
+// written to the audit log, accepted read calls only with audit_read_calls.
+func (main Main) authorize(w http.ResponseWriter, r *http.Request, role string) bool {
+	name, granted, ok := main.authenticate(r)
+	switch {
+	case !ok:
+		main.auditCall(r, AuditAdminReject, name, granted, role, "unauthenticated")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	case role == RoleAdmin && granted != RoleAdmin:
+		main.auditCall(r, AuditAdminReject, name, granted, role, "insufficient role")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if role == RoleAdmin || main.config.Load().AuditReadCalls {
+		main.auditCall(r, AuditAdminAccept, name, granted, role, "")
+	}
+	return true
+}
+
+// auditCall records an accepted or rejected admin call. The ring version is
+// unchanged by the call itself.
+func (main Main) auditCall(r *http.Request, action string, caller string, role string, required string, reason string) {
+	if caller == "" {
+		caller = "anonymous"
+	}
+	version := main.membership.Stats().Version
+	main.audit.Record(AuditRecord{
+		Action:     action,
+		Actor:      caller,
+		Reason:     reason,
+		OldVersion: version,
+		NewVersion: version,
+		Details: map[string]any{
+			"role":          role,
+			"required_role": required,
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			"remote_addr":   r.RemoteAddr,
+		},
+	})
+}
+
+// adminHandler wraps an admin API handler with the role check
+func (main Main) adminHandler(role string, handler func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !main.authorize(w, r, role) {
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// tlsConfig returns the TLS settings of the TLS listener. Client certificates
+// are optional so token callers can use it too, but any certificate presented
+// must be signed by the client CA.
+func tlsConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file")
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
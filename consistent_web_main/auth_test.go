@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestMain creates a router from config with its audit log kept in memory
+func newTestMain(t *testing.T, config Config) *Main {
+	t.Helper()
+	config.AuditLogFile = ""
+	config.LogLevel = "error"
+	main, err := NewMain(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return main
+}
+
+func TestAdminCallAudit(t *testing.T) {
+	tests := []struct {
+		name      string
+		readCalls bool
+		token     string
+		role      string
+		status    int
+		action    string
+	}{
+		{"accepted read call", false, "reader", RoleRead, http.StatusOK, ""},
+		{"accepted read call with audit_read_calls", true, "reader", RoleRead, http.StatusOK, AuditAdminAccept},
+		{"accepted admin call", false, "admin", RoleAdmin, http.StatusOK, AuditAdminAccept},
+		{"unauthenticated read call", false, "", RoleRead, http.StatusUnauthorized, AuditAdminReject},
+		{"forbidden admin call", false, "reader", RoleAdmin, http.StatusForbidden, AuditAdminReject},
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		config.AdminToken = "admin"
+		config.AdminTokens = []TokenConfig{{Name: "ops", Token: "reader", Role: RoleRead}}
+		config.AuditReadCalls = test.readCalls
+		main := newTestMain(t, config)
+
+		handler := main.adminHandler(test.role, func(w http.ResponseWriter, r *http.Request) {})
+		r := httptest.NewRequest(http.MethodGet, "/admin/nodes", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+
+		records := main.audit.Query(AuditQuery{Limit: 10})
+		switch {
+		case test.action == "" && len(records) != 0:
+			t.Errorf("%s: audited %+v, want nothing", test.name, records)
+		case test.action != "" && (len(records) != 1 || records[0].Action != test.action):
+			t.Errorf("%s: audited %+v, want one %s record", test.name, records, test.action)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"web_main/consistent_hash"
+
+	"go.uber.org/zap"
+)
+
+// cacheHotKeys is the body of a cache node's /hotkeys response
+type cacheHotKeys struct {
+	HotKeys []struct {
+		URL  string  `json:"url"`
+		Rate float64 `json:"rate"`
+	} `json:"hot_keys"`
+}
+
+// fetchNodeJSON gets path from a cache node and decodes its JSON response into v
+func (main Main) fetchNodeJSON(ctx context.Context, node consistent_hash.ServerNode, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%v%v", node.Addr, path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := main.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// pollCacheHotKeys periodically collects the hot keys every live cache node
+// measured itself, which includes requests clients send straight to the
+// cache, and merges them into the router's view of the node's namespace. The
+// rates of a URL are summed over nodes since each node only sees its own
+// share.
+func (main Main) pollCacheHotKeys() {
+	for {
+		config := main.config.Load()
+		names := []string{DefaultNamespace}
+		for _, namespace := range config.Namespaces {
+			names = append(names, namespace.Name)
+		}
+		if config.CacheReportInterval <= 0 {
+			// Polling is disabled, check again in case it is turned on by a reload
+			for _, name := range names {
+				main.namespaces.HotKeys(name, config).SetReported(make(map[string]float64))
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.CacheReportInterval)
+		reported := make(map[string]map[string]float64, len(names))
+		for _, name := range names {
+			reported[name] = make(map[string]float64)
+		}
+		for _, node := range main.membership.LiveNodes(config.HeartbeatTimeout) {
+			var report cacheHotKeys
+			if err := main.fetchNodeJSON(ctx, node, "/hotkeys", &report); err != nil {
+				main.logger.Debug("Error fetching hot keys from node", zap.String("node", node.ID), zap.Error(err))
+				continue
+			}
+			namespace, ok := reported[main.membership.NamespaceOf(node.ID)]
+			if !ok {
+				continue
+			}
+			for _, key := range report.HotKeys {
+				namespace[key.URL] += key.Rate
+			}
+		}
+		cancel()
+		for name, rates := range reported {
+			main.namespaces.HotKeys(name, config).SetReported(rates)
+		}
+
+		time.Sleep(config.CacheReportInterval)
+	}
+}
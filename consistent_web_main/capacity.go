@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Capacity measures how many requests per second the router sends to each
+// live node and derives the hot key threshold from it: with an adaptive
+// fraction configured, a URL is hot when its rate exceeds that fraction of
+// the most one node has been seen to serve.
+type Capacity struct {
+	// routed is the decayed count of every request the router has routed
+	routed HotKeyEntry
+	// peak is the highest per-node rate seen, decaying over the capacity half-life
+	peak        float64
+	peakUpdated time.Time
+	mutex       sync.Mutex
+	// threshold and nodeCapacity hold float64 bits so handlers read them without locking
+	threshold    atomic.Uint64
+	nodeCapacity atomic.Uint64
+}
+
+func NewCapacity(threshold float64) *Capacity {
+	capacity := &Capacity{}
+	capacity.threshold.Store(math.Float64bits(threshold))
+	return capacity
+}
+
+// Record counts one routed request at now
+func (c *Capacity) Record(now time.Time, halfLife time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.routed = c.routed.record(now.UnixNano(), decayRate(halfLife))
+}
+
+// Update recalculates the per-node capacity and the active threshold from the
+// routed rate spread over liveNodes. It returns the active threshold.
+func (c *Capacity) Update(now time.Time, liveNodes int, config *Config) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	lambda := decayRate(config.HotKeyHalfLife)
+	perNode := 0.0
+	if liveNodes > 0 {
+		perNode = c.routed.at(now.UnixNano(), lambda) * lambda / float64(liveNodes)
+	}
+	if !c.peakUpdated.IsZero() {
+		c.peak *= math.Exp(-decayRate(config.CapacityHalfLife) * now.Sub(c.peakUpdated).Seconds())
+	}
+	c.peak = math.Max(c.peak, perNode)
+	c.peakUpdated = now
+	c.nodeCapacity.Store(math.Float64bits(c.peak))
+
+	threshold := config.HotKeyThreshold
+	if config.AdaptiveThresholdFraction > 0 && c.peak > 0 {
+		threshold = math.Max(config.AdaptiveThresholdMin, config.AdaptiveThresholdFraction*c.peak)
+	}
+	c.threshold.Store(math.Float64bits(threshold))
+	return threshold
+}
+
+// Threshold returns the active hot key threshold in requests per second
+func (c *Capacity) Threshold() float64 {
+	return math.Float64frombits(c.threshold.Load())
+}
+
+// NodeCapacity returns the estimated requests per second one node serves
+func (c *Capacity) NodeCapacity() float64 {
+	return math.Float64frombits(c.nodeCapacity.Load())
+}
+
+// trackCapacity recalculates the hot key threshold every second so it follows
+// the measured load as well as nodes joining and leaving
+func (main Main) trackCapacity() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	previous := main.capacity.Threshold()
+	for now := range ticker.C {
+		config := main.config.Load()
+		liveNodes := main.membership.LiveCount(config.HeartbeatTimeout)
+		threshold := main.capacity.Update(now, liveNodes, config)
+		if math.Abs(threshold-previous) > 0.1*previous {
+			main.logger.Info("Hot key threshold changed", zap.Float64("threshold", threshold),
+				zap.Float64("node_capacity", main.capacity.NodeCapacity()), zap.Int("live_nodes", liveNodes))
+			previous = threshold
+		}
+	}
+}
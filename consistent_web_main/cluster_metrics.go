@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cacheMetrics is the body of a cache node's /metrics response
+type cacheMetrics struct {
+	Hits     int64 `json:"hits"`
+	Requests int64 `json:"requests"`
+	Entries  int64 `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// NodeMetrics is one cache node's view in the cluster metrics. Request rates
+// and routed shares cover the interval since the previous scrape.
+type NodeMetrics struct {
+	ID          string  `json:"id"`
+	Addr        string  `json:"addr"`
+	Up          bool    `json:"up"`
+	Error       string  `json:"error,omitempty"`
+	Hits        int64   `json:"hits"`
+	Requests    int64   `json:"requests"`
+	HitRate     float64 `json:"hit_rate"`
+	RequestRate float64 `json:"request_rate"`
+	Entries     int64   `json:"entries"`
+	Bytes       int64   `json:"bytes"`
+	RoutedShare float64 `json:"routed_share"`
+	RingShare   float64 `json:"ring_share"`
+}
+
+// ClusterMetrics combines the metrics of every live cache node
+type ClusterMetrics struct {
+	Updated     time.Time     `json:"updated"`
+	Nodes       []NodeMetrics `json:"nodes"`
+	Hits        int64         `json:"hits"`
+	Requests    int64         `json:"requests"`
+	HitRate     float64       `json:"hit_rate"`
+	RequestRate float64       `json:"request_rate"`
+	Entries     int64         `json:"entries"`
+	Bytes       int64         `json:"bytes"`
+}
+
+// clusterScrape holds the counters of the previous scrape, used to turn
+// cumulative counters into rates
+type clusterScrape struct {
+	time     time.Time
+	requests map[string]int64
+	routed   map[string]uint64
+}
+
+// scrapeClusterMetrics collects the metrics of every live cache node once
+func (main Main) scrapeClusterMetrics(ctx context.Context, previous clusterScrape) (ClusterMetrics, clusterScrape) {
+	config := main.config.Load()
+	now := time.Now()
+	elapsed := now.Sub(previous.time).Seconds()
+	shares := main.membership.RingShares()
+	routed := main.metrics.Routed()
+	current := clusterScrape{time: now, requests: make(map[string]int64), routed: routed}
+
+	var routedTotal uint64
+	for id, count := range routed {
+		routedTotal += count - previous.routed[id]
+	}
+
+	cluster := ClusterMetrics{Updated: now, Nodes: make([]NodeMetrics, 0)}
+	for _, node := range main.membership.LiveNodes(config.HeartbeatTimeout) {
+		metrics := NodeMetrics{ID: node.ID, Addr: node.Addr, RingShare: shares[node.ID]}
+		if routedTotal > 0 {
+			metrics.RoutedShare = float64(routed[node.ID]-previous.routed[node.ID]) / float64(routedTotal)
+		}
+
+		var report cacheMetrics
+		if err := main.fetchNodeJSON(ctx, node, "/metrics", &report); err != nil {
+			metrics.Error = err.Error()
+			cluster.Nodes = append(cluster.Nodes, metrics)
+			continue
+		}
+		metrics.Up = true
+		metrics.Hits, metrics.Requests = report.Hits, report.Requests
+		metrics.Entries, metrics.Bytes = report.Entries, report.Bytes
+		if report.Requests > 0 {
+			metrics.HitRate = float64(report.Hits) / float64(report.Requests)
+		}
+		// A node that restarted since the last scrape has reset its counters
+		if last, ok := previous.requests[node.ID]; ok && elapsed > 0 && report.Requests >= last {
+			metrics.RequestRate = float64(report.Requests-last) / elapsed
+		}
+		current.requests[node.ID] = report.Requests
+
+		cluster.Nodes = append(cluster.Nodes, metrics)
+		cluster.Hits += metrics.Hits
+		cluster.Requests += metrics.Requests
+		cluster.RequestRate += metrics.RequestRate
+		cluster.Entries += metrics.Entries
+		cluster.Bytes += metrics.Bytes
+	}
+	if cluster.Requests > 0 {
+		cluster.HitRate = float64(cluster.Hits) / float64(cluster.Requests)
+	}
+	return cluster, current
+}
+
+// pollClusterMetrics periodically scrapes the metrics of every live cache
+// node for /cluster/metrics
+func (main Main) pollClusterMetrics() {
+	var previous clusterScrape
+	for {
+		config := main.config.Load()
+		if config.ClusterMetricsInterval <= 0 {
+			// Scraping is disabled, check again in case it is turned on by a reload
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ClusterMetricsInterval)
+		var cluster ClusterMetrics
+		cluster, previous = main.scrapeClusterMetrics(ctx, previous)
+		cancel()
+		main.cluster.Store(&cluster)
+		main.logger.Debug("Scraped cluster metrics", zap.Int("nodes", len(cluster.Nodes)))
+
+		time.Sleep(config.ClusterMetricsInterval)
+	}
+}
+
+// processClusterMetrics reports the latest cluster metrics scrape
+func (main Main) processClusterMetrics(w http.ResponseWriter, r *http.Request) {
+	cluster := main.cluster.Load()
+	if cluster == nil {
+		http.Error(w, "Cluster metrics have not been collected yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster)
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"web_main/consistent_hash"
+	"web_main/gossip"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// NodeConfig describes a cache node the router starts with
+type NodeConfig struct {
+	ID       string `yaml:"id"`
+	Addr     string `yaml:"addr"`
+	Replicas int    `yaml:"replicas"`
+}
+
+// TokenConfig is a bearer token accepted by the admin endpoints. Name
+// identifies the caller in the audit log.
+type TokenConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// ClientCertConfig grants a role to TLS clients whose verified certificate has
+// the given common name
+type ClientCertConfig struct {
+	CommonName string `yaml:"common_name"`
+	Role       string `yaml:"role"`
+}
+
+// PeerConfig describes a router taking part in Raft replication. URL is where
+// followers redirect admin changes when the peer is the leader.
+type PeerConfig struct {
+	ID       string `yaml:"id"`
+	RaftAddr string `yaml:"raft_addr"`
+	URL      string `yaml:"url"`
+}
+
+// NamespaceConfig describes a namespace hosted by the router. Requests select
+// it by its name in the namespace header, one of its host names or its path
+// prefix, and are routed over the ring of the nodes it lists by ID. Zero hot
+// key settings keep the router's own, a zero quota rate is unlimited.
+type NamespaceConfig struct {
+	Name              string   `yaml:"name"`
+	Hosts             []string `yaml:"hosts"`
+	PathPrefix        string   `yaml:"path_prefix"`
+	Nodes             []string `yaml:"nodes"`
+	HotKeyThreshold   float64  `yaml:"hot_key_threshold"`
+	HotKeyMaxReplicas int      `yaml:"hot_key_max_replicas"`
+	// Requests per second the namespace may send and the burst allowed
+	// above that rate, which defaults to one second of requests
+	QuotaRate  float64 `yaml:"quota_rate"`
+	QuotaBurst int     `yaml:"quota_burst"`
+}
+
+// Config holds every tunable of the router. It is read from a YAML or JSON
+// file and can be overridden by command-line flags.
+type Config struct {
+	Port  int          `yaml:"port"`
+	Nodes []NodeConfig `yaml:"nodes"`
+
+	// Hot key detection and dispersal. The threshold is a rate in requests
+	// per second, measured by counts that halve every half-life.
+	HotKeyThreshold   float64       `yaml:"hot_key_threshold"`
+	HotKeyHalfLife    time.Duration `yaml:"hot_key_half_life"`
+	HotKeyMaxReplicas int           `yaml:"hot_key_max_replicas"`
+	// weighted picks a random replica by weight, choices picks the least
+	// loaded of HotKeyChoices random replicas
+	HotKeyRouting string `yaml:"hot_key_routing"`
+	HotKeyChoices int    `yaml:"hot_key_choices"`
+
+	// Adaptive threshold: when the fraction is positive the threshold is that
+	// fraction of the measured per-node capacity, but never below the minimum.
+	// The capacity estimate is the peak per-node rate decaying over its half-life.
+	AdaptiveThresholdFraction float64       `yaml:"adaptive_threshold_fraction"`
+	AdaptiveThresholdMin      float64       `yaml:"adaptive_threshold_min"`
+	CapacityHalfLife          time.Duration `yaml:"capacity_half_life"`
+
+	// Hot key tracking memory: URLs tracked exactly and Count-Min Sketch size
+	HotKeyCapacity    int `yaml:"hot_key_capacity"`
+	HotKeySketchWidth int `yaml:"hot_key_sketch_width"`
+	HotKeySketchDepth int `yaml:"hot_key_sketch_depth"`
+
+	// How often the hot keys measured by the cache nodes are collected, 0 disables it
+	CacheReportInterval time.Duration `yaml:"cache_report_interval"`
+	// How often the metrics of the cache nodes are scraped, 0 disables it
+	ClusterMetricsInterval time.Duration `yaml:"cluster_metrics_interval"`
+
+	// redirect sends clients to the cache node, proxy fetches from it for them
+	ForwardMode string `yaml:"forward_mode"`
+	// ProxyTimeout bounds a proxied request to a cache node, including its
+	// body, so a hung node cannot hold router goroutines. Set at startup.
+	ProxyTimeout time.Duration `yaml:"proxy_timeout"`
+
+	// Least-latency routing of proxied requests: among the first
+	// LatencyReplicas live owners of a URL, a request goes to the one with
+	// the lowest average response time unless the primary owner is within
+	// LatencySlack (a fraction) of it. Averages weight every response by
+	// LatencyEWMAWeight and are ignored after LatencyMaxAge without one.
+	// LatencyReplicas below 2 turns it off.
+	LatencyReplicas   int           `yaml:"latency_replicas"`
+	LatencySlack      float64       `yaml:"latency_slack"`
+	LatencyEWMAWeight float64       `yaml:"latency_ewma_weight"`
+	LatencyMaxAge     time.Duration `yaml:"latency_max_age"`
+
+	// Query parameters removed from URLs before they are hashed and cached,
+	// a trailing * matches every parameter with that prefix
+	URLStripParams []string `yaml:"url_strip_params"`
+
+	// Per-client rate limit in requests per second, 0 disables it. Clients
+	// are told apart by the ClientKeyHeader API key when it is set and sent,
+	// else by IP address. The burst defaults to one second of requests.
+	ClientRateLimit float64 `yaml:"client_rate_limit"`
+	ClientRateBurst int     `yaml:"client_rate_burst"`
+	ClientKeyHeader string  `yaml:"client_key_header"`
+
+	// Load shedding: requests are shed when the estimated load exceeds the
+	// live nodes times ShedNodeCapacity requests per second, or when the
+	// router is handling ShedMaxInFlight requests. 0 disables either.
+	ShedNodeCapacity float64 `yaml:"shed_node_capacity"`
+	ShedMaxInFlight  int     `yaml:"shed_max_in_flight"`
+
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+	RingAlgorithm    string        `yaml:"ring_algorithm"`
+	LogLevel         string        `yaml:"log_level"`
+
+	// Active health probing of HealthProbePath on every node, 0 interval
+	// disables it. A node failing HealthFailureThreshold probes in a row is
+	// skipped like a node without heartbeats until it passes
+	// HealthSuccessThreshold in a row. Each probe is delayed by a random part
+	// of HealthProbeJitter times the interval.
+	HealthProbeInterval    time.Duration `yaml:"health_probe_interval"`
+	HealthProbeTimeout     time.Duration `yaml:"health_probe_timeout"`
+	HealthProbeJitter      float64       `yaml:"health_probe_jitter"`
+	HealthProbePath        string        `yaml:"health_probe_path"`
+	HealthFailureThreshold int           `yaml:"health_failure_threshold"`
+	HealthSuccessThreshold int           `yaml:"health_success_threshold"`
+
+	// File the audit log of membership and config changes is appended to,
+	// empty keeps it in memory only
+	AuditLogFile string `yaml:"audit_log_file"`
+	// Admin calls that change the cluster and rejected calls are always
+	// audited, AuditReadCalls also audits accepted calls that only read it
+	AuditReadCalls bool `yaml:"audit_read_calls"`
+
+	// Admin authentication. AdminToken is a single token with the admin role,
+	// AdminTokens adds named tokens with their own roles.
+	AdminToken  string        `yaml:"admin_token"`
+	AdminTokens []TokenConfig `yaml:"admin_tokens"`
+	// Optional TLS listener on TLSPort serving the same endpoints. Clients
+	// presenting a certificate signed by ClientCAFile are authenticated by
+	// their common name.
+	TLSPort      int                `yaml:"tls_port"`
+	TLSCertFile  string             `yaml:"tls_cert_file"`
+	TLSKeyFile   string             `yaml:"tls_key_file"`
+	ClientCAFile string             `yaml:"client_ca_file"`
+	ClientCerts  []ClientCertConfig `yaml:"client_certs"`
+
+	// Raft replication of membership changes between routers. RaftID names
+	// this router in RaftPeers, which lists every router including this one.
+	// An empty RaftID runs a single router. The Raft log and snapshots are
+	// kept in RaftDir, raft-<id> by default.
+	RaftID    string       `yaml:"raft_id"`
+	RaftDir   string       `yaml:"raft_dir"`
+	RaftPeers []PeerConfig `yaml:"raft_peers"`
+
+	// Gossip membership. With GossipBind set the router joins the gossip of
+	// the cache nodes as an observer named GossipName, router-<port> by
+	// default, contacting the GossipJoin addresses, and adds, refreshes and
+	// deletes nodes as the gossip sees them. Heartbeats keep working.
+	// GossipKey is the base64 key the gossip is encrypted with, required with
+	// GossipBind since the gossip adds nodes to the ring.
+	GossipBind string   `yaml:"gossip_bind"`
+	GossipName string   `yaml:"gossip_name"`
+	GossipJoin []string `yaml:"gossip_join"`
+	GossipKey  string   `yaml:"gossip_key"`
+
+	// Namespaces sharing the router. Nodes not listed by any namespace and
+	// requests selecting none belong to the default namespace. An empty
+	// NamespaceHeader turns off selection by header.
+	Namespaces      []NamespaceConfig `yaml:"namespaces"`
+	NamespaceHeader string            `yaml:"namespace_header"`
+}
+
+// DefaultConfig returns the configuration the router used before it was
+// configurable
+func DefaultConfig() Config {
+	return Config{
+		Port:                   8080,
+		Nodes:                  []NodeConfig{{ID: "localhost:5050", Addr: "localhost:5050", Replicas: 1}},
+		HotKeyThreshold:        350.0,
+		HotKeyHalfLife:         1600 * time.Millisecond,
+		HotKeyMaxReplicas:      3,
+		HotKeyRouting:          HotKeyRoutingWeighted,
+		HotKeyChoices:          2,
+		CacheReportInterval:    5 * time.Second,
+		ClusterMetricsInterval: 10 * time.Second,
+		ForwardMode:            ForwardRedirect,
+		ProxyTimeout:           30 * time.Second,
+		LatencySlack:           0.5,
+		LatencyEWMAWeight:      0.3,
+		LatencyMaxAge:          10 * time.Second,
+		AdaptiveThresholdMin:   10.0,
+		CapacityHalfLife:       5 * time.Minute,
+		HotKeyCapacity:         1024,
+		HotKeySketchWidth:      4096,
+		HotKeySketchDepth:      4,
+		HeartbeatTimeout:       15 * time.Second,
+		HealthProbeInterval:    5 * time.Second,
+		HealthProbeTimeout:     time.Second,
+		HealthProbeJitter:      0.2,
+		HealthProbePath:        "/healthz",
+		HealthFailureThreshold: 3,
+		HealthSuccessThreshold: 2,
+		RingAlgorithm:          consistent_hash.AlgorithmKademlia,
+		LogLevel:               "debug",
+		AuditLogFile:           "audit.jsonl",
+		NamespaceHeader:        "X-Namespace",
+	}
+}
+
+// nodeListFlag collects repeated -node id,host:port,replicas flags
+type nodeListFlag []NodeConfig
+
+func (n *nodeListFlag) String() string {
+	entries := make([]string, 0, len(*n))
+	for _, node := range *n {
+		entries = append(entries, fmt.Sprintf("%s,%s,%d", node.ID, node.Addr, node.Replicas))
+	}
+	return strings.Join(entries, " ")
+}
+
+func (n *nodeListFlag) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("node must be id,host:port,replicas")
+	}
+	replicas, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return fmt.Errorf("error parsing replica count: %v", err)
+	}
+	*n = append(*n, NodeConfig{ID: parts[0], Addr: parts[1], Replicas: replicas})
+	return nil
+}
+
+// peerListFlag collects repeated -raft-peer id,host:port,url flags
+type peerListFlag []PeerConfig
+
+func (p *peerListFlag) String() string {
+	entries := make([]string, 0, len(*p))
+	for _, peer := range *p {
+		entries = append(entries, fmt.Sprintf("%s,%s,%s", peer.ID, peer.RaftAddr, peer.URL))
+	}
+	return strings.Join(entries, " ")
+}
+
+func (p *peerListFlag) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("raft peer must be id,host:port,url")
+	}
+	*p = append(*p, PeerConfig{ID: parts[0], RaftAddr: parts[1], URL: parts[2]})
+	return nil
+}
+
+// LoadConfig builds the router configuration from the defaults, the file
+// given with -config and finally any flags set explicitly on the command line
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+
+	flags := flag.NewFlagSet("web_main", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a YAML or JSON config file")
+	port := flags.Int("port", config.Port, "port the router listens on")
+	var nodes nodeListFlag
+	flags.Var(&nodes, "node", "cache node as id,host:port,replicas (repeatable, replaces the configured nodes)")
+	threshold := flags.Float64("threshold", config.HotKeyThreshold, "requests per second above which a URL is treated as hot")
+	adaptiveFraction := flags.Float64("adaptive-threshold-fraction", config.AdaptiveThresholdFraction, "fraction of measured per-node capacity used as the threshold (0 keeps -threshold)")
+	adaptiveMin := flags.Float64("adaptive-threshold-min", config.AdaptiveThresholdMin, "lowest threshold the adaptive threshold may fall to")
+	capacityHalfLife := flags.Duration("capacity-half-life", config.CapacityHalfLife, "half-life of the measured per-node capacity peak")
+	routing := flags.String("hot-key-routing", config.HotKeyRouting, "how hot URLs are spread over their replicas: weighted or choices")
+	choices := flags.Int("hot-key-choices", config.HotKeyChoices, "candidates compared by the choices routing mode")
+	metricsInterval := flags.Duration("cluster-metrics-interval", config.ClusterMetricsInterval, "how often the cache nodes' metrics are scraped (0 disables)")
+	reportInterval := flags.Duration("cache-report-interval", config.CacheReportInterval, "how often hot keys are collected from the cache nodes (0 disables)")
+	forwardMode := flags.String("forward-mode", config.ForwardMode, "how requests reach cache nodes: redirect or proxy")
+	proxyTimeout := flags.Duration("proxy-timeout", config.ProxyTimeout, "time after which a request proxied to a cache node is abandoned")
+	latencyReplicas := flags.Int("latency-replicas", config.LatencyReplicas, "ring owners compared by least-latency routing in proxy mode (below 2 disables it)")
+	latencySlack := flags.Float64("latency-slack", config.LatencySlack, "fraction by which the primary owner may be slower than the fastest replica and still be used")
+	latencyEWMAWeight := flags.Float64("latency-ewma-weight", config.LatencyEWMAWeight, "weight of the newest response time in each node's moving average")
+	latencyMaxAge := flags.Duration("latency-max-age", config.LatencyMaxAge, "time without a response after which a node's average response time is ignored")
+	clientRateLimit := flags.Float64("client-rate-limit", config.ClientRateLimit, "requests per second each client may send (0 disables)")
+	clientRateBurst := flags.Int("client-rate-burst", config.ClientRateBurst, "requests a client may send at once above its rate (0 is one second's worth)")
+	clientKeyHeader := flags.String("client-key-header", config.ClientKeyHeader, "request header with the API key identifying clients (empty uses IP addresses)")
+	shedNodeCapacity := flags.Float64("shed-node-capacity", config.ShedNodeCapacity, "requests per second one cache node serves, load above the cluster's total is shed (0 disables)")
+	shedMaxInFlight := flags.Int("shed-max-in-flight", config.ShedMaxInFlight, "requests the router handles at once before shedding (0 disables)")
+	stripParams := flags.String("url-strip-params", strings.Join(config.URLStripParams, ","), "comma-separated query parameters removed from URLs before hashing, such as utm_*")
+	maxReplicas := flags.Int("hot-key-max-replicas", config.HotKeyMaxReplicas, "most ring owners a hot URL is spread over")
+	halfLife := flags.Duration("half-life", config.HotKeyHalfLife, "half-life of the decayed request counts used to measure hot key rates")
+	hotKeyCapacity := flags.Int("hot-key-capacity", config.HotKeyCapacity, "number of hottest URLs tracked exactly")
+	sketchWidth := flags.Int("hot-key-sketch-width", config.HotKeySketchWidth, "counters in each row of the hot key sketch")
+	sketchDepth := flags.Int("hot-key-sketch-depth", config.HotKeySketchDepth, "rows of the hot key sketch")
+	timeout := flags.Duration("heartbeat-timeout", config.HeartbeatTimeout, "time without a heartbeat after which a node is deleted")
+	probeInterval := flags.Duration("health-probe-interval", config.HealthProbeInterval, "how often each node's health endpoint is probed (0 disables)")
+	probeTimeout := flags.Duration("health-probe-timeout", config.HealthProbeTimeout, "time after which a health probe fails")
+	probeJitter := flags.Float64("health-probe-jitter", config.HealthProbeJitter, "fraction of the probe interval each probe is delayed by at most, at random")
+	probePath := flags.String("health-probe-path", config.HealthProbePath, "path of the health endpoint probed on each node")
+	failureThreshold := flags.Int("health-failure-threshold", config.HealthFailureThreshold, "failed probes in a row after which a node is skipped")
+	successThreshold := flags.Int("health-success-threshold", config.HealthSuccessThreshold, "passed probes in a row after which a skipped node is used again")
+	algorithm := flags.String("ring", config.RingAlgorithm, "ring algorithm: kademlia, cycle or simple")
+	logLevel := flags.String("log-level", config.LogLevel, "log level: debug, info, warn or error")
+	auditLog := flags.String("audit-log", config.AuditLogFile, "file the audit log is appended to (empty keeps it in memory)")
+	auditReadCalls := flags.Bool("audit-read-calls", config.AuditReadCalls, "also audit accepted admin calls that only read the cluster")
+	adminToken := flags.String("admin-token", config.AdminToken, "bearer token with the admin role")
+	tlsPort := flags.Int("tls-port", config.TLSPort, "port of the TLS listener (0 disables it)")
+	tlsCert := flags.String("tls-cert", config.TLSCertFile, "certificate file of the TLS listener")
+	tlsKey := flags.String("tls-key", config.TLSKeyFile, "private key file of the TLS listener")
+	clientCA := flags.String("client-ca", config.ClientCAFile, "CA file used to verify admin client certificates")
+	raftID := flags.String("raft-id", config.RaftID, "ID of this router among the Raft peers (empty disables replication)")
+	raftDir := flags.String("raft-dir", config.RaftDir, "directory of the Raft log and snapshots")
+	var peers peerListFlag
+	flags.Var(&peers, "raft-peer", "router as id,host:port,url with its Raft address and admin URL (repeatable, replaces the configured peers)")
+	gossipBind := flags.String("gossip-bind", config.GossipBind, "host:port the router observes the cache gossip on (empty disables it)")
+	gossipName := flags.String("gossip-name", config.GossipName, "name of the router in the gossip")
+	gossipJoin := flags.String("gossip-join", strings.Join(config.GossipJoin, ","), "comma-separated gossip addresses of cache nodes to join")
+	gossipKey := flags.String("gossip-key", config.GossipKey, "base64 key of 16, 24 or 32 bytes the gossip is encrypted with")
+	namespaceHeader := flags.String("namespace-header", config.NamespaceHeader, "request header naming the namespace (empty disables it)")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return config, fmt.Errorf("error reading config file: %v", err)
+		}
+		// JSON is a subset of YAML so one decoder handles both formats.
+		// Unknown keys are rejected so a misspelled setting is not ignored.
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && err != io.EOF {
+			return config, fmt.Errorf("error parsing config file: %v", err)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = *port
+		case "node":
+			config.Nodes = nodes
+		case "threshold":
+			config.HotKeyThreshold = *threshold
+		case "adaptive-threshold-fraction":
+			config.AdaptiveThresholdFraction = *adaptiveFraction
+		case "adaptive-threshold-min":
+			config.AdaptiveThresholdMin = *adaptiveMin
+		case "capacity-half-life":
+			config.CapacityHalfLife = *capacityHalfLife
+		case "hot-key-routing":
+			config.HotKeyRouting = *routing
+		case "hot-key-choices":
+			config.HotKeyChoices = *choices
+		case "cache-report-interval":
+			config.CacheReportInterval = *reportInterval
+		case "cluster-metrics-interval":
+			config.ClusterMetricsInterval = *metricsInterval
+		case "forward-mode":
+			config.ForwardMode = *forwardMode
+		case "proxy-timeout":
+			config.ProxyTimeout = *proxyTimeout
+		case "latency-replicas":
+			config.LatencyReplicas = *latencyReplicas
+		case "latency-slack":
+			config.LatencySlack = *latencySlack
+		case "latency-ewma-weight":
+			config.LatencyEWMAWeight = *latencyEWMAWeight
+		case "latency-max-age":
+			config.LatencyMaxAge = *latencyMaxAge
+		case "client-rate-limit":
+			config.ClientRateLimit = *clientRateLimit
+		case "client-rate-burst":
+			config.ClientRateBurst = *clientRateBurst
+		case "client-key-header":
+			config.ClientKeyHeader = *clientKeyHeader
+		case "shed-node-capacity":
+			config.ShedNodeCapacity = *shedNodeCapacity
+		case "shed-max-in-flight":
+			config.ShedMaxInFlight = *shedMaxInFlight
+		case "url-strip-params":
+			config.URLStripParams = nil
+			if *stripParams != "" {
+				config.URLStripParams = strings.Split(*stripParams, ",")
+			}
+		case "hot-key-max-replicas":
+			config.HotKeyMaxReplicas = *maxReplicas
+		case "half-life":
+			config.HotKeyHalfLife = *halfLife
+		case "hot-key-capacity":
+			config.HotKeyCapacity = *hotKeyCapacity
+		case "hot-key-sketch-width":
+			config.HotKeySketchWidth = *sketchWidth
+		case "hot-key-sketch-depth":
+			config.HotKeySketchDepth = *sketchDepth
+		case "heartbeat-timeout":
+			config.HeartbeatTimeout = *timeout
+		case "health-probe-interval":
+			config.HealthProbeInterval = *probeInterval
+		case "health-probe-timeout":
+			config.HealthProbeTimeout = *probeTimeout
+		case "health-probe-jitter":
+			config.HealthProbeJitter = *probeJitter
+		case "health-probe-path":
+			config.HealthProbePath = *probePath
+		case "health-failure-threshold":
+			config.HealthFailureThreshold = *failureThreshold
+		case "health-success-threshold":
+			config.HealthSuccessThreshold = *successThreshold
+		case "ring":
+			config.RingAlgorithm = *algorithm
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "audit-log":
+			config.AuditLogFile = *auditLog
+		case "audit-read-calls":
+			config.AuditReadCalls = *auditReadCalls
+		case "admin-token":
+			config.AdminToken = *adminToken
+		case "tls-port":
+			config.TLSPort = *tlsPort
+		case "tls-cert":
+			config.TLSCertFile = *tlsCert
+		case "tls-key":
+			config.TLSKeyFile = *tlsKey
+		case "client-ca":
+			config.ClientCAFile = *clientCA
+		case "raft-id":
+			config.RaftID = *raftID
+		case "raft-dir":
+			config.RaftDir = *raftDir
+		case "raft-peer":
+			config.RaftPeers = peers
+		case "gossip-bind":
+			config.GossipBind = *gossipBind
+		case "gossip-name":
+			config.GossipName = *gossipName
+		case "gossip-join":
+			config.GossipJoin = strings.Split(*gossipJoin, ",")
+		case "gossip-key":
+			config.GossipKey = *gossipKey
+		case "namespace-header":
+			config.NamespaceHeader = *namespaceHeader
+		}
+	})
+
+	return config, config.Validate()
+}
+
+// Validate reports the first invalid setting in the configuration
+func (c Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("port %d out of range", c.Port)
+	}
+	if len(c.Nodes) == 0 && c.GossipBind == "" {
+		return fmt.Errorf("at least one node is required unless nodes join through gossip")
+	}
+	seen := make(map[string]bool)
+	for _, node := range c.Nodes {
+		if node.ID == "" {
+			return fmt.Errorf("node %q has no id", node.Addr)
+		}
+		if seen[node.ID] {
+			return fmt.Errorf("duplicate node id %q", node.ID)
+		}
+		seen[node.ID] = true
+		if !validNodeAddr(node.Addr) {
+			return fmt.Errorf("node %q address %q must be host:port", node.ID, node.Addr)
+		}
+		if node.Replicas <= 0 {
+			return fmt.Errorf("node %q must have at least one replica", node.ID)
+		}
+	}
+	if c.HotKeyThreshold <= 0 {
+		return fmt.Errorf("hot_key_threshold must be positive")
+	}
+	if c.HotKeyMaxReplicas <= 0 {
+		return fmt.Errorf("hot_key_max_replicas must be positive")
+	}
+	if c.AdaptiveThresholdFraction < 0 || c.AdaptiveThresholdMin < 0 || c.CapacityHalfLife <= 0 {
+		return fmt.Errorf("adaptive_threshold_fraction and adaptive_threshold_min cannot be negative and capacity_half_life must be positive")
+	}
+	if c.AdaptiveThresholdFraction > 0 && c.AdaptiveThresholdMin <= 0 {
+		return fmt.Errorf("adaptive_threshold_min must be positive when adaptive_threshold_fraction is set")
+	}
+	if c.HotKeyRouting != HotKeyRoutingWeighted && c.HotKeyRouting != HotKeyRoutingChoices {
+		return fmt.Errorf("unknown hot_key_routing %q", c.HotKeyRouting)
+	}
+	if c.HotKeyChoices <= 0 {
+		return fmt.Errorf("hot_key_choices must be positive")
+	}
+	if c.CacheReportInterval < 0 {
+		return fmt.Errorf("cache_report_interval cannot be negative")
+	}
+	if c.ClusterMetricsInterval < 0 {
+		return fmt.Errorf("cluster_metrics_interval cannot be negative")
+	}
+	if c.ForwardMode != ForwardRedirect && c.ForwardMode != ForwardProxy {
+		return fmt.Errorf("unknown forward_mode %q", c.ForwardMode)
+	}
+	if c.ProxyTimeout <= 0 {
+		return fmt.Errorf("proxy_timeout must be positive")
+	}
+	if c.LatencyReplicas < 0 || c.LatencySlack < 0 {
+		return fmt.Errorf("latency_replicas and latency_slack cannot be negative")
+	}
+	if c.LatencyEWMAWeight <= 0 || c.LatencyEWMAWeight > 1 || c.LatencyMaxAge <= 0 {
+		return fmt.Errorf("latency_ewma_weight must be in (0, 1] and latency_max_age positive")
+	}
+	if c.ClientRateLimit < 0 || c.ClientRateBurst < 0 {
+		return fmt.Errorf("client_rate_limit and client_rate_burst cannot be negative")
+	}
+	if c.ShedNodeCapacity < 0 || c.ShedMaxInFlight < 0 {
+		return fmt.Errorf("shed_node_capacity and shed_max_in_flight cannot be negative")
+	}
+	for _, param := range c.URLStripParams {
+		if param == "" {
+			return fmt.Errorf("url_strip_params entries cannot be empty")
+		}
+	}
+	if c.HotKeyHalfLife <= 0 {
+		return fmt.Errorf("hot_key_half_life must be positive")
+	}
+	if c.HotKeyCapacity <= 0 || c.HotKeySketchWidth <= 0 || c.HotKeySketchDepth <= 0 {
+		return fmt.Errorf("hot_key_capacity, hot_key_sketch_width and hot_key_sketch_depth must be positive")
+	}
+	if c.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("heartbeat_timeout must be positive")
+	}
+	if c.HealthProbeInterval < 0 {
+		return fmt.Errorf("health_probe_interval cannot be negative")
+	}
+	if c.HealthProbeTimeout <= 0 || c.HealthProbeJitter < 0 || c.HealthProbeJitter >= 1 {
+		return fmt.Errorf("health_probe_timeout must be positive and health_probe_jitter between 0 and 1")
+	}
+	if !strings.HasPrefix(c.HealthProbePath, "/") {
+		return fmt.Errorf("health_probe_path must start with /")
+	}
+	if c.HealthFailureThreshold <= 0 || c.HealthSuccessThreshold <= 0 {
+		return fmt.Errorf("health_failure_threshold and health_success_threshold must be positive")
+	}
+	if _, err := consistent_hash.New(c.RingAlgorithm, map[string]consistent_hash.ServerNode{}); err != nil {
+		return err
+	}
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	for _, token := range c.AdminTokens {
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("admin_tokens entries need a name and a token")
+		}
+		if token.Role != RoleRead && token.Role != RoleAdmin {
+			return fmt.Errorf("admin token %q has unknown role %q", token.Name, token.Role)
+		}
+	}
+	if c.TLSPort < 0 || c.TLSPort > 65535 || (c.TLSPort != 0 && c.TLSPort == c.Port) {
+		return fmt.Errorf("tls_port %d out of range or equal to port", c.TLSPort)
+	}
+	if c.TLSPort != 0 && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("tls_port requires tls_cert_file and tls_key_file")
+	}
+	if len(c.ClientCerts) > 0 && c.ClientCAFile == "" {
+		return fmt.Errorf("client_certs requires client_ca_file")
+	}
+	for _, cert := range c.ClientCerts {
+		if cert.CommonName == "" {
+			return fmt.Errorf("client_certs entries need a common_name")
+		}
+		if cert.Role != RoleRead && cert.Role != RoleAdmin {
+			return fmt.Errorf("client certificate %q has unknown role %q", cert.CommonName, cert.Role)
+		}
+	}
+	if c.RaftID != "" {
+		if _, ok := c.RaftPeer(c.RaftID); !ok {
+			return fmt.Errorf("raft_id %q is not in raft_peers", c.RaftID)
+		}
+		peers := make(map[string]bool)
+		for _, peer := range c.RaftPeers {
+			if peer.ID == "" || peers[peer.ID] {
+				return fmt.Errorf("raft_peers entries need a unique id")
+			}
+			peers[peer.ID] = true
+			if !validNodeAddr(peer.RaftAddr) {
+				return fmt.Errorf("raft peer %q address %q must be host:port", peer.ID, peer.RaftAddr)
+			}
+			if parsed, err := url.Parse(peer.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("raft peer %q url %q must be an http or https URL", peer.ID, peer.URL)
+			}
+		}
+	}
+	if c.GossipBind != "" && !validNodeAddr(c.GossipBind) {
+		return fmt.Errorf("gossip_bind %q must be host:port", c.GossipBind)
+	}
+	if c.GossipBind != "" {
+		if c.GossipKey == "" {
+			return fmt.Errorf("gossip_key is required with gossip_bind")
+		}
+		if _, err := gossip.ParseKey(c.GossipKey); err != nil {
+			return err
+		}
+	}
+	for _, seed := range c.GossipJoin {
+		if !validNodeAddr(seed) {
+			return fmt.Errorf("gossip_join address %q must be host:port", seed)
+		}
+	}
+	names := map[string]bool{DefaultNamespace: true}
+	hosts := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	assigned := make(map[string]bool)
+	for _, namespace := range c.Namespaces {
+		if namespace.Name == "" || names[namespace.Name] {
+			return fmt.Errorf("namespaces need a unique name other than %q", DefaultNamespace)
+		}
+		names[namespace.Name] = true
+		for _, host := range namespace.Hosts {
+			if host == "" || hosts[strings.ToLower(host)] {
+				return fmt.Errorf("namespace %q host %q is empty or used by another namespace", namespace.Name, host)
+			}
+			hosts[strings.ToLower(host)] = true
+		}
+		if prefix := namespace.PathPrefix; prefix != "" {
+			if !strings.HasPrefix(prefix, "/") || strings.TrimSuffix(prefix, "/") == "" || prefixes[strings.TrimSuffix(prefix, "/")] {
+				return fmt.Errorf("namespace %q path_prefix %q must start with / and be unique", namespace.Name, prefix)
+			}
+			prefixes[strings.TrimSuffix(prefix, "/")] = true
+		}
+		for _, id := range namespace.Nodes {
+			if assigned[id] {
+				return fmt.Errorf("node %q is in more than one namespace", id)
+			}
+			assigned[id] = true
+		}
+		if namespace.HotKeyThreshold < 0 || namespace.HotKeyMaxReplicas < 0 || namespace.QuotaRate < 0 || namespace.QuotaBurst < 0 {
+			return fmt.Errorf("namespace %q hot key settings and quota cannot be negative", namespace.Name)
+		}
+	}
+	return nil
+}
+
+// Namespace returns the settings of a namespace by name. The default
+// namespace uses the router's own settings without a quota.
+func (c Config) Namespace(name string) (NamespaceConfig, bool) {
+	if name == DefaultNamespace {
+		return NamespaceConfig{Name: DefaultNamespace}, true
+	}
+	for _, namespace := range c.Namespaces {
+		if namespace.Name == name {
+			return namespace, true
+		}
+	}
+	return NamespaceConfig{}, false
+}
+
+// NamespaceAssignments maps the IDs of the nodes listed by namespaces to their
+// namespace
+func (c Config) NamespaceAssignments() map[string]string {
+	assignments := make(map[string]string)
+	for _, namespace := range c.Namespaces {
+		for _, id := range namespace.Nodes {
+			assignments[id] = namespace.Name
+		}
+	}
+	return assignments
+}
+
+// RaftPeer returns the peer with the given ID
+func (c Config) RaftPeer(id string) (PeerConfig, bool) {
+	for _, peer := range c.RaftPeers {
+		if peer.ID == id {
+			return peer, true
+		}
+	}
+	return PeerConfig{}, false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateAdaptiveThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		fraction float64
+		min      float64
+		valid    bool
+	}{
+		{"disabled", 0, 0, true},
+		{"enabled", 0.8, 10, true},
+		{"zero min", 0.8, 0, false},
+		{"negative min", 0.8, -1, false},
+		{"negative fraction", -0.1, 10, false},
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		config.AdaptiveThresholdFraction = test.fraction
+		config.AdaptiveThresholdMin = test.min
+		if err := config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestLoadConfigFlags(t *testing.T) {
+	tests := []struct {
+		flag  string
+		check func(c Config) bool
+	}{
+		{"-adaptive-threshold-min=5", func(c Config) bool { return c.AdaptiveThresholdMin == 5 }},
+		{"-capacity-half-life=1m", func(c Config) bool { return c.CapacityHalfLife == time.Minute }},
+		{"-hot-key-sketch-width=128", func(c Config) bool { return c.HotKeySketchWidth == 128 }},
+		{"-hot-key-sketch-depth=2", func(c Config) bool { return c.HotKeySketchDepth == 2 }},
+		{"-latency-ewma-weight=0.5", func(c Config) bool { return c.LatencyEWMAWeight == 0.5 }},
+		{"-latency-max-age=3s", func(c Config) bool { return c.LatencyMaxAge == 3*time.Second }},
+		{"-health-probe-jitter=0.2", func(c Config) bool { return c.HealthProbeJitter == 0.2 }},
+		{"-health-probe-path=/ready", func(c Config) bool { return c.HealthProbePath == "/ready" }},
+	}
+	for _, test := range tests {
+		config, err := LoadConfig([]string{test.flag})
+		if err != nil {
+			t.Errorf("%s: %v", test.flag, err)
+			continue
+		}
+		if !test.check(config) {
+			t.Errorf("%s was not applied", test.flag)
+		}
+	}
+}
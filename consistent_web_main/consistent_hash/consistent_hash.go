@@ -0,0 +1,37 @@
+package consistent_hash
+
+import "fmt"
+
+// ConsistentHash is implemented by every ring algorithm in this package
+type ConsistentHash interface {
+	ValueLookup(value string) string
+	// ValueLookupN returns up to n distinct node IDs in order of preference
+	// for value. The first ID is the one ValueLookup returns.
+	ValueLookupN(value string, n int) []string
+	InsertNode(id string, addr string, replica_count int)
+	DeleteNode(id string)
+}
+
+// Names of the ring algorithms that can be selected with New
+const (
+	AlgorithmKademlia = "kademlia"
+	AlgorithmCycle    = "cycle"
+	AlgorithmSimple   = "simple"
+)
+
+// HashFunction names the hash every ring algorithm places nodes and keys with:
+// the first four bytes of the SHA-256 digest read as a little-endian uint32
+const HashFunction = "sha256-le32"
+
+// New builds the ring named by algorithm over the given nodes
+func New(algorithm string, nodeMap map[string]ServerNode) (ConsistentHash, error) {
+	switch algorithm {
+	case AlgorithmKademlia:
+		return NewTrie(nodeMap), nil
+	case AlgorithmCycle:
+		return NewConsistentHash(nodeMap), nil
+	case AlgorithmSimple:
+		return NewSimpleHash(nodeMap), nil
+	}
+	return nil, fmt.Errorf("unknown ring algorithm %q", algorithm)
+}
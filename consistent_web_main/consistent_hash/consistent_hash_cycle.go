@@ -10,37 +10,36 @@ import (
 )
 
 type consistentHash struct {
-	// maps virtual nodes value in cycle to their IP addresses
-	vnodeHashToAddress map[uint32]string
+	// maps virtual nodes value in cycle to their node IDs
+	vnodeHashToID map[uint32]string
 	// sorted list of virtual nodes
 	sortedVnodeHash []uint32
 	nodeMap         map[string]ServerNode
 	mux             sync.RWMutex
 }
 
-func (ch *consistentHash) getReplicaHashValues(ip string) []uint32 {
-	ch.mux.RLock()
-	defer ch.mux.RUnlock()
+// getReplicaHashValues must be called with ch.mux held
+func (ch *consistentHash) getReplicaHashValues(id string) []uint32 {
 	hashValues := make([]uint32, 0)
-	replica_count := ch.nodeMap[ip].Replicas
+	replica_count := ch.nodeMap[id].Replicas
 	for replicaNumber := 0; replicaNumber < replica_count; replicaNumber++ {
-		hashValues = append(hashValues, getTrieKey(fmt.Sprintf("%s-%d", ip, replicaNumber)))
+		hashValues = append(hashValues, getTrieKey(fmt.Sprintf("%s-%d", id, replicaNumber)))
 	}
 	return hashValues
 }
 
 func NewConsistentHash(nodeMap map[string]ServerNode) *consistentHash {
 	ch := &consistentHash{
-		vnodeHashToAddress: make(map[uint32]string),
-		sortedVnodeHash:    make([]uint32, 0),
-		nodeMap:            nodeMap,
+		vnodeHashToID:   make(map[uint32]string),
+		sortedVnodeHash: make([]uint32, 0),
+		nodeMap:         nodeMap,
 	}
 	// Note no other thread has access to ch yet so we don't need a lock here
-	// Add IP addresses to the hash table
-	for ip := range nodeMap {
-		for _, replica_hash := range ch.getReplicaHashValues(ip) {
+	// Add node IDs to the hash table
+	for id := range nodeMap {
+		for _, replica_hash := range ch.getReplicaHashValues(id) {
 			ch.sortedVnodeHash = append(ch.sortedVnodeHash, replica_hash)
-			ch.vnodeHashToAddress[replica_hash] = ip
+			ch.vnodeHashToID[replica_hash] = id
 		}
 	}
 
@@ -70,27 +69,55 @@ func (ch *consistentHash) ValueLookup(value string) string {
 		index = 0
 	}
 
-	return ch.vnodeHashToAddress[ch.sortedVnodeHash[index]]
+	return ch.vnodeHashToID[ch.sortedVnodeHash[index]]
+}
+
+// ValueLookupN returns the first n distinct nodes found walking clockwise from value
+func (ch *consistentHash) ValueLookupN(value string, n int) []string {
+	ch.mux.RLock()
+	defer ch.mux.RUnlock()
+	ids := make([]string, 0, n)
+	if len(ch.sortedVnodeHash) == 0 {
+		return ids
+	}
+
+	hash := getTrieKey(value)
+	index := sort.Search(len(ch.sortedVnodeHash), func(i int) bool {
+		return ch.sortedVnodeHash[i] >= hash
+	})
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(ch.sortedVnodeHash) && len(ids) < n; i++ {
+		id := ch.vnodeHashToID[ch.sortedVnodeHash[(index+i)%len(ch.sortedVnodeHash)]]
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
 }
 
-func (ch *consistentHash) InsertNode(ip_address string, replica_count int) {
+func (ch *consistentHash) InsertNode(id string, addr string, replica_count int) {
 	ch.mux.Lock()
 	defer ch.mux.Unlock()
-	// Update replica count if the node already exists
-	if entry, exists := ch.nodeMap[ip_address]; exists {
+	// Update replica count and address if the node already exists
+	if entry, exists := ch.nodeMap[id]; exists {
+		// Drop the old virtual nodes so a changed replica count leaves no stale ones behind
+		ch.deleteVnodes(id)
+		entry.Addr = addr
 		entry.Replicas = replica_count
-		ch.nodeMap[ip_address] = entry
+		ch.nodeMap[id] = entry
 	} else {
 		timeStamp := time.Now().Add(60 * time.Second)
-		entry := ServerNode{IP: ip_address, Timestamp: timeStamp, Replicas: replica_count}
-		ch.nodeMap[ip_address] = entry
+		entry := ServerNode{ID: id, Addr: addr, Timestamp: timeStamp, Replicas: replica_count}
+		ch.nodeMap[id] = entry
 	}
 
 	// Insert the virtual nodes
-	for replica_number, replica_hash := range ch.getReplicaHashValues(ip_address) {
+	for replica_number, replica_hash := range ch.getReplicaHashValues(id) {
 		ch.sortedVnodeHash = append(ch.sortedVnodeHash, replica_hash)
-		ch.vnodeHashToAddress[replica_hash] = ip_address
-		log.Printf("Inserted IP %v, replica number %v\n", ip_address, replica_number)
+		ch.vnodeHashToID[replica_hash] = id
+		log.Printf("Inserted node %v (%v), replica number %v\n", id, addr, replica_number)
 	}
 
 	// Sort the virtual nodes for easy lookup
@@ -99,11 +126,18 @@ func (ch *consistentHash) InsertNode(ip_address string, replica_count int) {
 	})
 }
 
-func (ch *consistentHash) DeleteNode(ip string) {
+func (ch *consistentHash) DeleteNode(id string) {
 	ch.mux.Lock()
 	defer ch.mux.Unlock()
-	for _, replica_hash := range ch.getReplicaHashValues(ip) {
-		delete(ch.vnodeHashToAddress, replica_hash)
+	ch.deleteVnodes(id)
+	// Delete from nodeMap
+	delete(ch.nodeMap, id)
+}
+
+// deleteVnodes must be called with ch.mux held
+func (ch *consistentHash) deleteVnodes(id string) {
+	for _, replica_hash := range ch.getReplicaHashValues(id) {
+		delete(ch.vnodeHashToID, replica_hash)
 
 		// Delete from sortedVnodeHash
 		index := sort.Search(len(ch.sortedVnodeHash), func(i int) bool {
@@ -114,43 +148,41 @@ func (ch *consistentHash) DeleteNode(ip string) {
 			ch.sortedVnodeHash = append(ch.sortedVnodeHash[:index], ch.sortedVnodeHash[index+1:]...)
 		}
 	}
-	// Delete from nodeMap
-	delete(ch.nodeMap, ip)
 }
 
 // Thus funciton is used soley for testing purposes
 func CycleMain() {
 	timestamp := time.Now().Add(60 * time.Second)
-	nodeList := []ServerNode{{IP: "localhost", Timestamp: timestamp, Replicas: 10}, {IP: "10.30.147.20", Timestamp: timestamp, Replicas: 3}}
+	nodeList := []ServerNode{{ID: "localhost", Addr: "localhost:5050", Timestamp: timestamp, Replicas: 10}, {ID: "10.30.147.20", Addr: "10.30.147.20:5050", Timestamp: timestamp, Replicas: 3}}
 	replica_count := 0
 
 	nodeMap := make(map[string]ServerNode)
 	for _, node := range nodeList {
-		nodeMap[node.IP] = node
+		nodeMap[node.ID] = node
 		replica_count += node.Replicas
 	}
 	consistentHash := NewConsistentHash(nodeMap)
 
-	ipAddressCount := make(map[string]int)
+	nodeCount := make(map[string]int)
 	numCalls := 10000
 	for i := 0; i < numCalls; i++ {
 		url := fmt.Sprintf("www.%v.com", rand.IntN(100000))
-		ip := consistentHash.ValueLookup(url)
-		ipAddressCount[ip]++
+		id := consistentHash.ValueLookup(url)
+		nodeCount[id]++
 	}
 
 	fmt.Println("Expected vs True Count Per Node: ")
-	for ip, node := range nodeMap {
-		fmt.Printf("IP: %v, Expected Count: %v, True Count: %v\n", ip, node.Replicas*numCalls/replica_count, ipAddressCount[ip])
+	for id, node := range nodeMap {
+		fmt.Printf("Node: %v, Expected Count: %v, True Count: %v\n", id, node.Replicas*numCalls/replica_count, nodeCount[id])
 	}
 
 	// Delete all nodes
-	for ip := range nodeMap {
-		consistentHash.DeleteNode(ip)
+	for id := range nodeMap {
+		consistentHash.DeleteNode(id)
 	}
 
 	// Insert a new node
-	consistentHash.InsertNode("localhost2", 2)
+	consistentHash.InsertNode("localhost2", "localhost:5051", 2)
 
 	// Search for a value
 	fmt.Println(consistentHash.ValueLookup("www.google.com"))
@@ -11,16 +11,19 @@ import (
 	"time"
 )
 
+// ServerNode identifies a cache node by a stable ID and the host:port it
+// advertises for client traffic.
 type ServerNode struct {
-	IP        string
+	ID        string
+	Addr      string
 	Timestamp time.Time
 	Replicas  int
 }
 
 type TrieNode struct {
-	children  [2]*TrieNode
-	isServer  bool
-	ipAddress string
+	children [2]*TrieNode
+	isServer bool
+	nodeID   string
 }
 
 type Trie struct {
@@ -40,9 +43,13 @@ func NewTrie(nodeMap map[string]ServerNode) *Trie {
 	}
 	// Note no other thread has access to trie yet so we don't need a lock here
 
-	// Add IP addresses to the hash table
-	for ip := range nodeMap {
-		trie.InsertNode(ip, nodeMap[ip].Replicas)
+	// Add node IDs to the hash table. The replicas are inserted directly
+	// rather than through InsertNode, which logs every replica, since the
+	// router rebuilds namespace rings on every ring change.
+	for id, node := range nodeMap {
+		for replica_number := 0; replica_number < node.Replicas; replica_number++ {
+			trie.insert(id, replica_number)
+		}
 	}
 	return trie
 }
@@ -56,8 +63,8 @@ func getTrieKey(key string) uint32 {
 	return trie_key
 }
 
-func (t *Trie) insert(ip_address string, replica_number int) {
-	trie_key := getTrieKey(ip_address + strconv.Itoa(replica_number))
+func (t *Trie) insert(id string, replica_number int) {
+	trie_key := getTrieKey(id + strconv.Itoa(replica_number))
 	node := t.root
 	for i := 31; i >= 0; i-- {
 		index := (trie_key >> i) & 1
@@ -67,7 +74,7 @@ func (t *Trie) insert(ip_address string, replica_number int) {
 		node = node.children[index]
 	}
 	node.isServer = true
-	node.ipAddress = ip_address
+	node.nodeID = id
 }
 
 func (t *Trie) ValueLookup(key string) string {
@@ -83,18 +90,49 @@ func (t *Trie) ValueLookup(key string) string {
 			node = node.children[index]
 		}
 	}
-	return node.ipAddress
+	return node.nodeID
 }
 
-func (t *Trie) DeleteNode(ip_address string) {
+// ValueLookupN returns the n distinct nodes closest to key by XOR distance,
+// found by preferring the branch matching key at every level
+func (t *Trie) ValueLookupN(key string, n int) []string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	ids := make([]string, 0, n)
+	t.collectClosest(t.root, getTrieKey(key), 31, n, make(map[string]bool), &ids)
+	return ids
+}
+
+func (t *Trie) collectClosest(node *TrieNode, trie_key uint32, bitIndex int, n int, seen map[string]bool, ids *[]string) {
+	if node == nil || len(*ids) >= n {
+		return
+	}
+	if bitIndex < 0 {
+		if node.isServer && !seen[node.nodeID] {
+			seen[node.nodeID] = true
+			*ids = append(*ids, node.nodeID)
+		}
+		return
+	}
+	index := (trie_key >> bitIndex) & 1
+	t.collectClosest(node.children[index], trie_key, bitIndex-1, n, seen, ids)
+	t.collectClosest(node.children[1-index], trie_key, bitIndex-1, n, seen, ids)
+}
+
+func (t *Trie) DeleteNode(id string) {
 	t.mux.Lock()
 	defer t.mux.Unlock()
-	replica_count := t.nodeMap[ip_address].Replicas
+	t.deleteReplicas(id)
+	delete(t.nodeMap, id)
+}
+
+// deleteReplicas must be called with t.mux held
+func (t *Trie) deleteReplicas(id string) {
+	replica_count := t.nodeMap[id].Replicas
 	for replica_number := 0; replica_number < replica_count; replica_number++ {
-		trie_key := getTrieKey(ip_address + strconv.Itoa(replica_number))
+		trie_key := getTrieKey(id + strconv.Itoa(replica_number))
 		t.root = t.deleteRecursive(t.root, trie_key, 31)
 	}
-	delete(t.nodeMap, ip_address)
 }
 
 func (t *Trie) deleteRecursive(node *TrieNode, trie_key uint32, bitIndex int) *TrieNode {
@@ -123,55 +161,58 @@ func (t *Trie) deleteRecursive(node *TrieNode, trie_key uint32, bitIndex int) *T
 	return node
 }
 
-func (t *Trie) InsertNode(ip_address string, replica_count int) {
+func (t *Trie) InsertNode(id string, addr string, replica_count int) {
 	t.mux.Lock()
 	defer t.mux.Unlock()
-	// Upadte replica count if the node already exists
-	if entry, ok := t.nodeMap[ip_address]; ok {
+	// Upadte replica count and address if the node already exists
+	if entry, ok := t.nodeMap[id]; ok {
+		// Drop the old replicas so a lower replica count leaves no stale ones behind
+		t.deleteReplicas(id)
+		entry.Addr = addr
 		entry.Replicas = replica_count
-		t.nodeMap[ip_address] = entry
+		t.nodeMap[id] = entry
 	} else {
 		timestamp := time.Now().Add(60 * time.Second)
-		entry := ServerNode{IP: ip_address, Timestamp: timestamp, Replicas: replica_count}
-		t.nodeMap[ip_address] = entry
+		entry := ServerNode{ID: id, Addr: addr, Timestamp: timestamp, Replicas: replica_count}
+		t.nodeMap[id] = entry
 	}
 	for replica_number := 0; replica_number < replica_count; replica_number++ {
-		t.insert(ip_address, replica_number)
-		log.Printf("Inserted IP %v, replica number %v\n", ip_address, replica_number)
+		t.insert(id, replica_number)
+		log.Printf("Inserted node %v (%v), replica number %v\n", id, addr, replica_number)
 	}
 }
 
 // Thus function is used solely for testing purposes
 func KademliaMain() {
 	timestamp := time.Now().Add(60 * time.Second)
-	nodeList := []ServerNode{{IP: "localhost", Timestamp: timestamp, Replicas: 10}, {IP: "10.30.147.20", Timestamp: timestamp, Replicas: 3}}
+	nodeList := []ServerNode{{ID: "localhost", Addr: "localhost:5050", Timestamp: timestamp, Replicas: 10}, {ID: "10.30.147.20", Addr: "10.30.147.20:5050", Timestamp: timestamp, Replicas: 3}}
 	replica_count := 0
 
 	nodeMap := make(map[string]ServerNode)
 	for _, node := range nodeList {
-		nodeMap[node.IP] = node
+		nodeMap[node.ID] = node
 		replica_count += node.Replicas
 	}
 	consistentHash := NewTrie(nodeMap)
 
-	ipAddressCount := make(map[string]int)
+	nodeCount := make(map[string]int)
 	numCalls := 10000
 	for i := 0; i < numCalls; i++ {
 		url := fmt.Sprintf("www.%v.com", rand.IntN(100000))
-		ip := consistentHash.ValueLookup(url)
-		ipAddressCount[ip]++
+		id := consistentHash.ValueLookup(url)
+		nodeCount[id]++
 	}
 
 	fmt.Println("Expected vs True Count Per Node: ")
-	for ip, node := range nodeMap {
-		fmt.Printf("IP: %v, Expected Count: %v, True Count: %v\n", ip, node.Replicas*numCalls/replica_count, ipAddressCount[ip])
+	for id, node := range nodeMap {
+		fmt.Printf("Node: %v, Expected Count: %v, True Count: %v\n", id, node.Replicas*numCalls/replica_count, nodeCount[id])
 	}
 
 	// Delete a node
-	for ip := range nodeMap {
-		consistentHash.DeleteNode(ip)
+	for id := range nodeMap {
+		consistentHash.DeleteNode(id)
 	}
 
-	consistentHash.InsertNode("localhost2", 1)
+	consistentHash.InsertNode("localhost2", "localhost:5051", 1)
 	fmt.Println(consistentHash.ValueLookup("www.google.com"))
 }
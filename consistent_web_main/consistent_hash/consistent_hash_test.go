@@ -0,0 +1,93 @@
+package consistent_hash
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testNodes() map[string]ServerNode {
+	nodes := make(map[string]ServerNode)
+	for i, replicas := range []int{1, 5, 10, 20} {
+		id := fmt.Sprintf("node%d", i)
+		nodes[id] = ServerNode{ID: id, Addr: id + ":5050", Replicas: replicas}
+	}
+	return nodes
+}
+
+func TestValueLookupN(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmKademlia, AlgorithmCycle, AlgorithmSimple} {
+		ring, err := New(algorithm, testNodes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			n    int
+			want int
+		}{
+			{0, 0},
+			{1, 1},
+			{3, 3},
+			{4, 4},
+			// There are only four distinct nodes
+			{10, 4},
+		}
+		for key := 0; key < 100; key++ {
+			value := fmt.Sprintf("http://example.com/%d", key)
+			owner := ring.ValueLookup(value)
+			for _, test := range tests {
+				ids := ring.ValueLookupN(value, test.n)
+				if len(ids) != test.want {
+					t.Fatalf("%s: ValueLookupN(%q, %d) = %v, want %d IDs", algorithm, value, test.n, ids, test.want)
+				}
+				if len(ids) > 0 && ids[0] != owner {
+					t.Fatalf("%s: ValueLookupN(%q, %d) = %v, want %s first", algorithm, value, test.n, ids, owner)
+				}
+				seen := make(map[string]bool)
+				for _, id := range ids {
+					if seen[id] {
+						t.Fatalf("%s: ValueLookupN(%q, %d) = %v has duplicates", algorithm, value, test.n, ids)
+					}
+					seen[id] = true
+				}
+			}
+			// A longer list extends a shorter one
+			short, long := ring.ValueLookupN(value, 2), ring.ValueLookupN(value, 4)
+			if short[0] != long[0] || short[1] != long[1] {
+				t.Fatalf("%s: ValueLookupN(%q) 2 = %v is not a prefix of 4 = %v", algorithm, value, short, long)
+			}
+		}
+	}
+}
+
+func TestValueLookupNAfterChanges(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmKademlia, AlgorithmCycle, AlgorithmSimple} {
+		ring, err := New(algorithm, testNodes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring.DeleteNode("node3")
+		ring.InsertNode("node1", "node1:5050", 2)
+		for key := 0; key < 100; key++ {
+			value := fmt.Sprintf("http://example.com/%d", key)
+			ids := ring.ValueLookupN(value, 10)
+			if len(ids) != 3 {
+				t.Fatalf("%s: ValueLookupN(%q, 10) = %v, want 3 IDs", algorithm, value, ids)
+			}
+			for _, id := range ids {
+				if id == "node3" {
+					t.Fatalf("%s: ValueLookupN(%q, 10) = %v includes a deleted node", algorithm, value, ids)
+				}
+			}
+		}
+	}
+
+	for _, algorithm := range []string{AlgorithmKademlia, AlgorithmCycle, AlgorithmSimple} {
+		ring, err := New(algorithm, map[string]ServerNode{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := ring.ValueLookupN("http://example.com/", 3); len(ids) != 0 {
+			t.Errorf("%s: ValueLookupN on an empty ring = %v, want none", algorithm, ids)
+		}
+	}
+}
@@ -17,10 +17,12 @@ func NewSimpleHash(nodeMap map[string]ServerNode) *SimpleHash {
 	var size int = 0
 	orderedKeys := make([]string, 0)
 
-	for ip, node := range nodeMap  {
+	for id, node := range nodeMap  {
 		size += node.Replicas
-		orderedKeys = append(orderedKeys, ip)
+		orderedKeys = append(orderedKeys, id)
 	}
+	// Keep IDs sorted so lookups do not depend on map order and DeleteNode can search them
+	sort.Strings(orderedKeys)
 	h := &SimpleHash{
 		orderedKeys:                 orderedKeys,
 		nodeMap:                     nodeMap,
@@ -30,37 +32,41 @@ func NewSimpleHash(nodeMap map[string]ServerNode) *SimpleHash {
 	return h
 }
 
-func (h *SimpleHash) InsertNode(ip_address string, replica_count int) {
+func (h *SimpleHash) InsertNode(id string, addr string, replica_count int) {
 	h.mux.Lock()
 	defer h.mux.Unlock()
-	if entry, ok := h.nodeMap[ip_address]; ok {
+	if entry, ok := h.nodeMap[id]; ok {
 		h.sizeInclRepls -= entry.Replicas
+		entry.Addr = addr
 		entry.Replicas = replica_count
 		h.sizeInclRepls += entry.Replicas
 
-		// Note that this changes the distribution for other keys after the ip address
+		// Note that this changes the distribution for other keys after the node
 		// this is fine because regardless the other keys will be changed
-		h.nodeMap[ip_address] = entry
+		h.nodeMap[id] = entry
 	} else {
 		timestamp := time.Now().Add(60 * time.Second)
-		h.nodeMap[ip_address] = ServerNode{IP: ip_address, Timestamp: timestamp, Replicas: replica_count}
-		h.orderedKeys = append(h.orderedKeys, ip_address)
+		h.nodeMap[id] = ServerNode{ID: id, Addr: addr, Timestamp: timestamp, Replicas: replica_count}
+		index := sort.SearchStrings(h.orderedKeys, id)
+		h.orderedKeys = append(h.orderedKeys, "")
+		copy(h.orderedKeys[index+1:], h.orderedKeys[index:])
+		h.orderedKeys[index] = id
 		h.sizeInclRepls += replica_count
 	}
 }
 
-func (h *SimpleHash) DeleteNode(ip string) {
+func (h *SimpleHash) DeleteNode(id string) {
 	h.mux.Lock()
 	defer h.mux.Unlock()
-	h.sizeInclRepls -= h.nodeMap[ip].Replicas
+	h.sizeInclRepls -= h.nodeMap[id].Replicas
 	index := sort.Search(len(h.orderedKeys), func(i int) bool {
-		return h.orderedKeys[i] >= ip
+		return h.orderedKeys[i] >= id
 	})
 
-	if index < len(h.orderedKeys) && h.orderedKeys[index] == ip {
+	if index < len(h.orderedKeys) && h.orderedKeys[index] == id {
 		h.orderedKeys = append(h.orderedKeys[:index], h.orderedKeys[index+1:]...)
 	}
-	delete(h.nodeMap, ip)
+	delete(h.nodeMap, id)
 }
 
 func (h *SimpleHash) ValueLookup(value string) string {
@@ -68,11 +74,33 @@ func (h *SimpleHash) ValueLookup(value string) string {
 	defer h.mux.RUnlock()
 	replica_idx := (int) (getTrieKey(value)) % h.sizeInclRepls
 	var tempSize int = 0
-	for _, ip := range h.orderedKeys {
-		tempSize += h.nodeMap[ip].Replicas
+	for _, id := range h.orderedKeys {
+		tempSize += h.nodeMap[id].Replicas
 		if replica_idx < tempSize {
-			return ip
+			return id
 		}
 	}
 	return ""
-}
\ No newline at end of file
+}
+
+// ValueLookupN returns the owner of value followed by the nodes after it
+func (h *SimpleHash) ValueLookupN(value string, n int) []string {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	ids := make([]string, 0, n)
+	if h.sizeInclRepls == 0 {
+		return ids
+	}
+	replica_idx := (int) (getTrieKey(value)) % h.sizeInclRepls
+	var tempSize int = 0
+	for start, id := range h.orderedKeys {
+		tempSize += h.nodeMap[id].Replicas
+		if replica_idx < tempSize {
+			for i := 0; i < len(h.orderedKeys) && len(ids) < n; i++ {
+				ids = append(ids, h.orderedKeys[(start+i)%len(h.orderedKeys)])
+			}
+			break
+		}
+	}
+	return ids
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"web_main/consistent_hash"
+	"web_main/ringclient"
+)
+
+// processRingDiscovery publishes the ring so clients using the ringclient
+// package can route requests to cache nodes without going through the router.
+// The optional namespace query parameter selects the ring of a namespace.
+func (main Main) processRingDiscovery(w http.ResponseWriter, r *http.Request) {
+	config := main.config.Load()
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		name = DefaultNamespace
+	}
+	if _, ok := config.Namespace(name); !ok {
+		http.Error(w, "Unknown namespace", http.StatusNotFound)
+		return
+	}
+	version, nodes, live := main.membership.RingNodes(name, config.HeartbeatTimeout)
+	ring := ringclient.Ring{
+		Namespace:   name,
+		Version:     version,
+		Algorithm:   config.RingAlgorithm,
+		Hash:        consistent_hash.HashFunction,
+		StripParams: config.URLStripParams,
+		Nodes:       make([]ringclient.Node, 0, len(nodes)),
+	}
+	for _, node := range nodes {
+		ring.Nodes = append(ring.Nodes, ringclient.Node{ID: node.ID, Addr: node.Addr, Replicas: node.Replicas, Live: live[node.ID]})
+	}
+	writeJSON(w, ring)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"web_main/consistent_hash"
+	"web_main/ringclient"
+)
+
+func TestRingClientMatchesRouter(t *testing.T) {
+	down := []struct {
+		name string
+		set  func(m *Membership)
+	}{
+		{"all live", func(m *Membership) {}},
+		{"failing probes", func(m *Membership) {
+			m.SetHealthy("b", false)
+		}},
+		{"missed heartbeats", func(m *Membership) {
+			m.mutex.Lock()
+			node := m.nodes["c"]
+			node.Timestamp = time.Now().Add(-time.Hour)
+			m.nodes["c"] = node
+			m.mutex.Unlock()
+		}},
+		{"draining", func(m *Membership) {
+			m.SetState("d", NodeDraining, Change{})
+		}},
+	}
+	algorithms := []string{consistent_hash.AlgorithmKademlia, consistent_hash.AlgorithmCycle, consistent_hash.AlgorithmSimple}
+	for _, algorithm := range algorithms {
+		for _, test := range down {
+			config := DefaultConfig()
+			config.RingAlgorithm = algorithm
+			config.Nodes = []NodeConfig{
+				{ID: "a", Addr: "localhost:5051", Replicas: 1},
+				{ID: "b", Addr: "localhost:5052", Replicas: 2},
+				{ID: "c", Addr: "localhost:5053", Replicas: 1},
+				{ID: "d", Addr: "localhost:5054", Replicas: 3},
+			}
+			main := newTestMain(t, config)
+			test.set(main.membership)
+
+			server := httptest.NewServer(http.HandlerFunc(main.processRingDiscovery))
+			client, err := ringclient.New(context.Background(), server.URL)
+			server.Close()
+			if err != nil {
+				t.Fatalf("%s %s: %v", algorithm, test.name, err)
+			}
+
+			mismatches := 0
+			for i := 0; i < 500; i++ {
+				url := fmt.Sprintf("http://example.com/page-%d", i)
+				owners := main.membership.Owners(DefaultNamespace, url, 1, config.HeartbeatTimeout)
+				node, err := client.Lookup(url)
+				if err != nil || len(owners) == 0 || node.ID != owners[0].ID {
+					mismatches++
+				}
+			}
+			if mismatches > 0 {
+				t.Errorf("%s %s: client and router disagree on %d of 500 URLs", algorithm, test.name, mismatches)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"web_main/consistent_hash"
+)
+
+// hotReplicaCount returns how many of a hot URL's ring owners share its
+// requests. A URL at the threshold rate is spread over two nodes and every
+// further multiple of the threshold adds one more, up to maxReplicas. A
+// threshold that is not positive or a rate that gives no finite ratio counts as
+// not hot.
+func hotReplicaCount(rate float64, threshold float64, maxReplicas int) int {
+	ratio := rate / threshold
+	if threshold <= 0 || math.IsNaN(ratio) || math.IsInf(ratio, 0) || ratio < 0 || maxReplicas <= 1 {
+		return 1
+	}
+	// Compare before converting so a huge ratio cannot overflow the int
+	if ratio >= float64(maxReplicas-1) {
+		return maxReplicas
+	}
+	return 1 + int(math.Floor(ratio))
+}
+
+// pickWeighted picks one of nodes at random with probability proportional to
+// its replica count, so larger nodes take a larger share of a hot URL
+func pickWeighted(nodes []consistent_hash.ServerNode) consistent_hash.ServerNode {
+	total := 0
+	for _, node := range nodes {
+		total += node.Replicas
+	}
+	choice := rand.Intn(total)
+	for _, node := range nodes {
+		if choice < node.Replicas {
+			return node
+		}
+		choice -= node.Replicas
+	}
+	return nodes[len(nodes)-1]
+}
+
+// Ways a hot URL's requests are spread over its replica set
+const (
+	HotKeyRoutingWeighted = "weighted"
+	HotKeyRoutingChoices  = "choices"
+)
+
+// pickLeastLoaded draws d candidates from nodes by weight and returns the one
+// with the fewest in-flight requests per replica (power of d choices)
+func pickLeastLoaded(nodes []consistent_hash.ServerNode, d int, inFlight *InFlight) consistent_hash.ServerNode {
+	best := pickWeighted(nodes)
+	bestLoad := float64(inFlight.Get(best.ID)) / float64(best.Replicas)
+	for i := 1; i < d; i++ {
+		candidate := pickWeighted(nodes)
+		load := float64(inFlight.Get(candidate.ID)) / float64(candidate.Replicas)
+		if load < bestLoad {
+			best, bestLoad = candidate, load
+		}
+	}
+	return best
+}
+
+// pickHotNode picks the node serving the next request for a hot URL from its
+// replica set using the configured routing mode
+func (main Main) pickHotNode(nodes []consistent_hash.ServerNode, config *Config) consistent_hash.ServerNode {
+	if config.HotKeyRouting == HotKeyRoutingChoices {
+		return pickLeastLoaded(nodes, config.HotKeyChoices, main.inFlight)
+	}
+	return pickWeighted(nodes)
+}
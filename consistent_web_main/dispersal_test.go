@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHotReplicaCount(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		threshold   float64
+		maxReplicas int
+		want        int
+	}{
+		{"below threshold", 50, 100, 3, 1},
+		{"at threshold", 100, 100, 3, 2},
+		{"two thresholds", 250, 100, 5, 3},
+		{"capped", 1000, 100, 3, 3},
+		{"huge ratio", 1e300, 1e-5, 3, 3},
+		{"zero threshold", 100, 0, 3, 1},
+		{"negative threshold", 100, -1, 3, 1},
+		{"nan rate", math.NaN(), 100, 3, 1},
+		{"infinite rate", math.Inf(1), 100, 3, 1},
+		{"zero max replicas", 1000, 100, 0, 1},
+	}
+	for _, test := range tests {
+		if got := hotReplicaCount(test.rate, test.threshold, test.maxReplicas); got != test.want {
+			t.Errorf("%s: hotReplicaCount(%v, %v, %d) = %d, want %d", test.name, test.rate, test.threshold, test.maxReplicas, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"web_main/consistent_hash"
+)
+
+// Ways the router hands a request to the chosen cache node
+const (
+	ForwardRedirect = "redirect"
+	ForwardProxy    = "proxy"
+)
+
+// InFlight counts the requests the router is currently proxying to each node
+type InFlight struct {
+	counts sync.Map // node ID -> *atomic.Int64
+}
+
+func (f *InFlight) counter(id string) *atomic.Int64 {
+	counter, _ := f.counts.LoadOrStore(id, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+// Get returns the number of requests in flight to the node
+func (f *InFlight) Get(id string) int64 {
+	return f.counter(id).Load()
+}
+
+// forward sends the client to node for url, either by redirecting it or by
+// proxying the request and copying back the node's response
+func (main Main) forward(w http.ResponseWriter, r *http.Request, node consistent_hash.ServerNode, url string, mode string) {
+	if mode != ForwardProxy {
+		http.Redirect(w, r, nodeURL(node, url), http.StatusTemporaryRedirect)
+		return
+	}
+
+	counter := main.inFlight.counter(node.ID)
+	counter.Add(1)
+	defer counter.Add(-1)
+
+	// The request is abandoned when the client goes away
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, nodeURL(node, url), nil)
+	if err != nil {
+		http.Error(w, "Error reaching cache node", http.StatusBadGateway)
+		return
+	}
+	start := time.Now()
+	resp, err := main.client.Do(req)
+	if err != nil {
+		http.Error(w, "Error reaching cache node", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	// The time to the response headers covers the node's work, unlike the
+	// body copy, which depends on the client
+	main.responseTimes.Record(node.ID, time.Since(start), time.Now(), main.config.Load().LatencyEWMAWeight)
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,207 @@
+// Package gossip joins the SWIM gossip run by the web_cache nodes as an
+// observer. Cache nodes advertise their HTTP address and weight in their
+// gossip metadata, so an observer can build the same ring as the router from
+// its own view of the cluster, without heartbeats. Observers take part in
+// failure detection but are never part of the ring.
+package gossip
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Roles advertised in the gossip metadata
+const (
+	RoleCache    = "cache"
+	RoleObserver = "observer"
+)
+
+// Meta is the metadata every gossip member advertises. Addr and Replicas are
+// only set by cache nodes. Leaving is set by a node shutting down just before
+// it leaves, so its departure is not mistaken for a failure.
+type Meta struct {
+	Role     string `json:"role"`
+	Addr     string `json:"addr,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+	Leaving  bool   `json:"leaving,omitempty"`
+}
+
+// Member is a cache node in the gossip view. ID is its gossip name.
+type Member struct {
+	ID       string
+	Addr     string
+	Replicas int
+}
+
+// Event types delivered by an Observer
+const (
+	// MemberJoin is sent when a cache node joins or changes its metadata
+	MemberJoin = iota
+	// MemberLeft is sent when a cache node announces it is leaving the
+	// gossip, and again once it left
+	MemberLeft
+	// MemberDead is sent when a cache node failed its probes
+	MemberDead
+)
+
+// Event is a change to a cache node in the gossip view
+type Event struct {
+	Type   int
+	Member Member
+}
+
+// Observer is a gossip member that follows the cache nodes
+type Observer struct {
+	list   *memberlist.Memberlist
+	nodes  chan memberlist.NodeEvent
+	events chan Event
+}
+
+// ParseKey decodes a base64 gossip encryption key. Every member of the gossip
+// must use the same key, of 16, 24 or 32 bytes.
+func ParseKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("gossip key must be base64: %v", err)
+	}
+	if len(decoded) != 16 && len(decoded) != 24 && len(decoded) != 32 {
+		return nil, fmt.Errorf("gossip key must be 16, 24 or 32 bytes, got %d", len(decoded))
+	}
+	return decoded, nil
+}
+
+// NewObserver joins the gossip under name, listening on bind (host:port) and
+// contacting the seeds, also given as host:port. Seeds that cannot be reached
+// are skipped, and if none answers the observer keeps trying in the
+// background. Gossip messages are encrypted and authenticated with key.
+func NewObserver(name string, bind string, seeds []string, key []byte, logger *log.Logger) (*Observer, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+	config := memberlist.DefaultLANConfig()
+	config.Name = name
+	config.BindAddr = host
+	config.BindPort, err = strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing gossip port: %v", err)
+	}
+	config.AdvertisePort = config.BindPort
+	config.SecretKey = key
+	config.Logger = logger
+	config.Delegate = metaDelegate{Meta{Role: RoleObserver}}
+
+	o := &Observer{nodes: make(chan memberlist.NodeEvent, 256), events: make(chan Event, 256)}
+	config.Events = &memberlist.ChannelEventDelegate{Ch: o.nodes}
+	o.list, err = memberlist.Create(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(seeds) > 0 {
+		if _, err := o.list.Join(seeds); err != nil {
+			logger.Printf("[WARN] Error joining gossip, retrying: %v", err)
+			go o.rejoin(seeds)
+		}
+	}
+	go o.translate()
+	return o, nil
+}
+
+// rejoinInterval is how often an observer that could not reach its seeds
+// tries again
+const rejoinInterval = 5 * time.Second
+
+// rejoin retries joining the seeds until one of them answers
+func (o *Observer) rejoin(seeds []string) {
+	for {
+		time.Sleep(rejoinInterval)
+		if _, err := o.list.Join(seeds); err == nil {
+			return
+		}
+	}
+}
+
+// translate turns memberlist events about cache nodes into Events
+func (o *Observer) translate() {
+	for event := range o.nodes {
+		member, leaving, ok := cacheMember(event.Node)
+		if !ok {
+			continue
+		}
+		switch {
+		case leaving:
+			o.events <- Event{Type: MemberLeft, Member: member}
+		case event.Event == memberlist.NodeLeave:
+			o.events <- Event{Type: MemberDead, Member: member}
+		default:
+			o.events <- Event{Type: MemberJoin, Member: member}
+		}
+	}
+}
+
+// Events returns the changes to the cache nodes as they are detected
+func (o *Observer) Events() <-chan Event {
+	return o.events
+}
+
+// Members returns the cache nodes that are alive or suspected of failing,
+// but not the ones leaving, sorted by ID
+func (o *Observer) Members() []Member {
+	members := make([]Member, 0)
+	for _, node := range o.list.Members() {
+		if member, leaving, ok := cacheMember(node); ok && !leaving {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// Size returns the number of gossip members alive, observers included
+func (o *Observer) Size() int {
+	return o.list.NumMembers()
+}
+
+// Leave announces that the observer leaves and stops gossiping
+func (o *Observer) Leave(timeout time.Duration) error {
+	if err := o.list.Leave(timeout); err != nil {
+		return err
+	}
+	return o.list.Shutdown()
+}
+
+// cacheMember decodes the member of a cache node and whether it is leaving.
+// It returns false for other members and metadata it cannot read.
+func cacheMember(node *memberlist.Node) (Member, bool, bool) {
+	var meta Meta
+	if err := json.Unmarshal(node.Meta, &meta); err != nil || meta.Role != RoleCache {
+		return Member{}, false, false
+	}
+	return Member{ID: node.Name, Addr: meta.Addr, Replicas: meta.Replicas}, meta.Leaving, true
+}
+
+// metaDelegate advertises the member's metadata. The cluster carries no other
+// state, so the rest of the delegate is empty.
+type metaDelegate struct {
+	meta Meta
+}
+
+func (d metaDelegate) NodeMeta(limit int) []byte {
+	data, _ := json.Marshal(d.meta)
+	return data
+}
+
+func (d metaDelegate) NotifyMsg([]byte)                           {}
+func (d metaDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d metaDelegate) LocalState(join bool) []byte                { return nil }
+func (d metaDelegate) MergeRemoteState(buf []byte, join bool)     {}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+	"web_main/gossip"
+
+	"go.uber.org/zap"
+)
+
+// followGossip keeps the membership in line with the gossip view of the cache
+// nodes. Joins and departures are applied as they are gossiped, and every
+// second the live members have their heartbeat timestamps refreshed, so they
+// only expire if the router loses the gossip.
+func (main Main) followGossip() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-main.gossip.Events():
+			main.gossipEvent(event)
+		case <-ticker.C:
+			for _, member := range main.gossip.Members() {
+				main.membership.Heartbeat(member.ID)
+			}
+		}
+	}
+}
+
+func (main Main) gossipEvent(event gossip.Event) {
+	switch event.Type {
+	case gossip.MemberJoin:
+		main.gossipJoin(event.Member)
+	case gossip.MemberLeft:
+		main.gossipChange(membershipCommand{Op: opDelete, ID: event.Member.ID, Actor: "gossip", Reason: "left the gossip"})
+	case gossip.MemberDead:
+		main.gossipChange(membershipCommand{Op: opExpire, ID: event.Member.ID, Actor: "gossip", Reason: "failed gossip probes"})
+	}
+}
+
+// gossipJoin adds a cache node that joined the gossip with its advertised
+// address and weight. A node the router already knows keeps the address and
+// weight it has, since those are changed through the admin API and config
+// reloads, and only has its heartbeat timestamp refreshed.
+func (main Main) gossipJoin(member gossip.Member) {
+	if member.Addr == "" || member.Replicas <= 0 {
+		return
+	}
+	if _, ok := main.membership.Node(member.ID); !ok {
+		main.gossipChange(membershipCommand{Op: opInsert, ID: member.ID, Addr: member.Addr, Replicas: member.Replicas,
+			Actor: "gossip", Reason: "joined the gossip"})
+	}
+	main.membership.Heartbeat(member.ID)
+}
+
+// gossipChange applies a change seen in the gossip. Replicated routers all
+// observe the gossip but only the leader applies it.
+func (main Main) gossipChange(cmd membershipCommand) {
+	if _, err := main.applyChange(cmd); err != nil && err != errNotLeader {
+		main.logger.Warn("Error applying gossip change", zap.String("op", cmd.Op), zap.String("node", cmd.ID), zap.Error(err))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NodeHealth is the outcome of the recent health probes of a node
+type NodeHealth struct {
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	Failures             uint64    `json:"failures"`
+	LastProbe            time.Time `json:"last_probe"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// Health keeps the probe results of every node. Nodes start out healthy so
+// they are not skipped before their first probes.
+type Health struct {
+	nodes map[string]*NodeHealth
+	mutex sync.Mutex
+}
+
+func NewHealth() *Health {
+	return &Health{nodes: make(map[string]*NodeHealth)}
+}
+
+// Record adds the result of a probe, err is nil if it passed. A node becomes
+// unhealthy after failureThreshold failures in a row and healthy again after
+// successThreshold successes in a row. It returns the node's health and
+// whether the probe changed it.
+func (h *Health) Record(id string, err error, failureThreshold int, successThreshold int) (NodeHealth, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	health, ok := h.nodes[id]
+	if !ok {
+		health = &NodeHealth{Healthy: true}
+		h.nodes[id] = health
+	}
+	health.LastProbe = time.Now()
+	was := health.Healthy
+	if err != nil {
+		health.ConsecutiveFailures++
+		health.ConsecutiveSuccesses = 0
+		health.Failures++
+		health.LastError = err.Error()
+		if health.ConsecutiveFailures >= failureThreshold {
+			health.Healthy = false
+		}
+	} else {
+		health.ConsecutiveSuccesses++
+		health.ConsecutiveFailures = 0
+		health.LastError = ""
+		if health.ConsecutiveSuccesses >= successThreshold {
+			health.Healthy = true
+		}
+	}
+	return *health, health.Healthy != was
+}
+
+// Get returns the health of a node, false if it has not been probed
+func (h *Health) Get(id string) (NodeHealth, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	health, ok := h.nodes[id]
+	if !ok {
+		return NodeHealth{}, false
+	}
+	return *health, true
+}
+
+// All returns the health of every probed node
+func (h *Health) All() map[string]NodeHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	all := make(map[string]NodeHealth, len(h.nodes))
+	for id, health := range h.nodes {
+		all[id] = *health
+	}
+	return all
+}
+
+// Retain forgets the nodes not in ids
+func (h *Health) Retain(ids []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+	for id := range h.nodes {
+		if !keep[id] {
+			delete(h.nodes, id)
+		}
+	}
+}
+
+// probeNodes probes the health endpoint of every known node each interval,
+// including nodes already failing so they can recover. Each probe is delayed
+// by a random part of the jitter so the nodes are not all probed at once.
+// A node is live only while it both sends heartbeats and passes its probes.
+func (main Main) probeNodes() {
+	for {
+		config := main.config.Load()
+		if config.HealthProbeInterval <= 0 {
+			// Probing is disabled, nodes are judged by heartbeats alone
+			// until it is turned on by a reload
+			for _, id := range main.membership.IDs() {
+				main.membership.SetHealthy(id, true)
+			}
+			main.health.Retain(nil)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		start := time.Now()
+		nodes := main.membership.Nodes()
+		ids := make([]string, 0, len(nodes))
+		var wg sync.WaitGroup
+		for _, node := range nodes {
+			ids = append(ids, node.ID)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(time.Duration(rand.Float64() * config.HealthProbeJitter * float64(config.HealthProbeInterval)))
+				main.probeNode(node.ID, node.Addr, config)
+			}()
+		}
+		wg.Wait()
+		main.health.Retain(ids)
+
+		time.Sleep(config.HealthProbeInterval - time.Since(start))
+	}
+}
+
+// probeNode probes one node and updates its health in the membership
+func (main Main) probeNode(id string, addr string, config *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.HealthProbeTimeout)
+	defer cancel()
+	err := main.probe(ctx, addr, config.HealthProbePath)
+
+	health, changed := main.health.Record(id, err, config.HealthFailureThreshold, config.HealthSuccessThreshold)
+	if !changed {
+		return
+	}
+	main.membership.SetHealthy(id, health.Healthy)
+	if health.Healthy {
+		main.logger.Info("Node passes health probes again", zap.String("node", id))
+	} else {
+		main.logger.Warn("Node failed health probes", zap.String("node", id),
+			zap.Int("consecutive_failures", health.ConsecutiveFailures), zap.String("error", health.LastError))
+	}
+}
+
+// probe sends one health probe, any response but 200 is a failure
+func (main Main) probe(ctx context.Context, addr string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%v%v", addr, path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := main.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
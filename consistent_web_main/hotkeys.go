@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotKeyHistorySize is the number of past hot episodes kept for inspection
+const hotKeyHistorySize = 100
+
+// decayRate returns the per-second decay constant of a count that halves
+// every halfLife. A steady stream of r requests per second keeps the decayed
+// count at r/decayRate, so count*decayRate estimates the request rate.
+func decayRate(halfLife time.Duration) float64 {
+	return math.Ln2 / halfLife.Seconds()
+}
+
+// HotKeyEntry is an exponentially decayed count of requests for a URL as of
+// Updated, in Unix nanoseconds
+type HotKeyEntry struct {
+	Count   float64
+	Updated int64
+}
+
+// at returns the entry's count decayed to now without recording a request
+func (e HotKeyEntry) at(now int64, lambda float64) float64 {
+	if now <= e.Updated {
+		return e.Count
+	}
+	return e.Count * math.Exp(-lambda*(float64)(now-e.Updated)/float64(time.Second))
+}
+
+// record returns the entry after one more request at now
+func (e HotKeyEntry) record(now int64, lambda float64) HotKeyEntry {
+	if now < e.Updated {
+		// Requests may be recorded slightly out of order, count them at the latest time
+		now = e.Updated
+	}
+	return HotKeyEntry{Count: e.at(now, lambda) + 1, Updated: now}
+}
+
+// HotKeys tracks request rates per URL in fixed memory. Every request updates
+// a Count-Min Sketch of decayed counts, and the URLs with the highest counts
+// are kept exactly in a bounded min-heap (heavy hitters). A URL that is not in
+// the heap is admitted when its sketch estimate beats the coldest entry.
+type HotKeys struct {
+	sketch   [][]HotKeyEntry
+	top      hotKeyHeap
+	index    map[string]*hotKey
+	capacity int
+	history  []HotKeyEpisode
+	// reported holds the request rates the cache nodes measured themselves,
+	// summed over nodes and replaced on every poll
+	reported map[string]float64
+	mutex    sync.Mutex
+}
+
+type hotKey struct {
+	url   string
+	entry HotKeyEntry
+	index int
+	// hotSince is when the URL crossed the threshold, zero while it is not hot
+	hotSince time.Time
+	peak     float64
+}
+
+// HotKeyStatus describes a tracked URL as of the time it was read
+type HotKeyStatus struct {
+	URL      string
+	Rate     float64
+	HotSince time.Time
+}
+
+// HotKeyEpisode records a period during which a URL was hot
+type HotKeyEpisode struct {
+	URL      string    `json:"url"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	PeakRate float64   `json:"peak_rate"`
+}
+
+// Keys creates a tracker holding at most capacity URLs exactly, backed by a
+// sketch of depth rows with width counters each
+func Keys(capacity int, width int, depth int) *HotKeys {
+	sketch := make([][]HotKeyEntry, depth)
+	for row := range sketch {
+		sketch[row] = make([]HotKeyEntry, width)
+	}
+	return &HotKeys{
+		sketch:   sketch,
+		index:    make(map[string]*hotKey, capacity),
+		capacity: capacity,
+		reported: make(map[string]float64),
+	}
+}
+
+// sketchColumns returns the counter used for url in every sketch row, derived
+// from two halves of one 64-bit hash
+func (hk *HotKeys) sketchColumns(url string) []int {
+	hash := fnv.New64a()
+	hash.Write([]byte(url))
+	sum := hash.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	columns := make([]int, len(hk.sketch))
+	for row := range hk.sketch {
+		columns[row] = int((h1 + uint32(row)*h2) % uint32(len(hk.sketch[row])))
+	}
+	return columns
+}
+
+// Record counts a request for url at now with counts halving every halfLife.
+// It returns the URL's request rate per second from before the request, or
+// the rate reported by the cache nodes if that is higher. A URL is hot while
+// that rate is at or above threshold.
+func (hk *HotKeys) Record(url string, now time.Time, halfLife time.Duration, threshold float64) float64 {
+	hk.mutex.Lock()
+	defer hk.mutex.Unlock()
+
+	lambda := decayRate(halfLife)
+	if lambda != hk.top.lambda {
+		// Heap order depends on the decay rate, so rebuild it when the half-life is reloaded
+		hk.top.lambda = lambda
+		heap.Init(&hk.top)
+	}
+	nanos := now.UnixNano()
+
+	// Update the sketch and take the smallest counter as the estimate
+	estimate := HotKeyEntry{Count: math.Inf(1), Updated: nanos}
+	previous := math.Inf(1)
+	for row, column := range hk.sketchColumns(url) {
+		counter := hk.sketch[row][column]
+		previous = math.Min(previous, counter.at(nanos, lambda))
+		counter = counter.record(nanos, lambda)
+		hk.sketch[row][column] = counter
+		estimate.Count = math.Min(estimate.Count, counter.Count)
+	}
+
+	if key, ok := hk.index[url]; ok {
+		rate := math.Max(key.entry.at(nanos, lambda)*lambda, hk.reported[url])
+		key.entry = key.entry.record(nanos, lambda)
+		hk.updateHotness(key, rate, now, threshold)
+		heap.Fix(&hk.top, key.index)
+		return rate
+	}
+
+	var key *hotKey
+	if hk.top.Len() < hk.capacity {
+		key = &hotKey{url: url, entry: estimate}
+		heap.Push(&hk.top, key)
+		hk.index[url] = key
+	} else if coldest := hk.top.keys[0]; coldest.entry.at(nanos, lambda) < estimate.Count {
+		if !coldest.hotSince.IsZero() {
+			hk.endEpisode(coldest, now)
+		}
+		delete(hk.index, coldest.url)
+		coldest.url = url
+		coldest.entry = estimate
+		hk.index[url] = coldest
+		heap.Fix(&hk.top, 0)
+		key = coldest
+	}
+	rate := math.Max(previous*lambda, hk.reported[url])
+	if key != nil {
+		hk.updateHotness(key, rate, now, threshold)
+	}
+	return rate
+}
+
+// updateHotness starts or ends the URL's hot episode given the rate used to
+// decide whether it is hot
+func (hk *HotKeys) updateHotness(key *hotKey, rate float64, now time.Time, threshold float64) {
+	if rate >= threshold {
+		if key.hotSince.IsZero() {
+			key.hotSince = now
+		}
+		key.peak = math.Max(key.peak, rate)
+	} else if !key.hotSince.IsZero() {
+		hk.endEpisode(key, now)
+	}
+}
+
+// endEpisode moves the URL's current hot episode into the history
+func (hk *HotKeys) endEpisode(key *hotKey, now time.Time) {
+	hk.history = append(hk.history, HotKeyEpisode{URL: key.url, Start: key.hotSince, End: now, PeakRate: key.peak})
+	if len(hk.history) > hotKeyHistorySize {
+		hk.history = hk.history[len(hk.history)-hotKeyHistorySize:]
+	}
+	key.hotSince = time.Time{}
+	key.peak = 0
+}
+
+// SetReported replaces the request rates reported by the cache nodes
+func (hk *HotKeys) SetReported(reported map[string]float64) {
+	hk.mutex.Lock()
+	defer hk.mutex.Unlock()
+	hk.reported = reported
+}
+
+// Top returns the n URLs with the highest request rates as of now, hottest
+// first, including URLs only the cache nodes have reported
+func (hk *HotKeys) Top(n int, now time.Time, halfLife time.Duration) []HotKeyStatus {
+	hk.mutex.Lock()
+	defer hk.mutex.Unlock()
+	lambda := decayRate(halfLife)
+	statuses := make([]HotKeyStatus, 0, hk.top.Len()+len(hk.reported))
+	for _, key := range hk.top.keys {
+		rate := math.Max(key.entry.at(now.UnixNano(), lambda)*lambda, hk.reported[key.url])
+		statuses = append(statuses, HotKeyStatus{URL: key.url, Rate: rate, HotSince: key.hotSince})
+	}
+	for url, rate := range hk.reported {
+		if _, ok := hk.index[url]; !ok {
+			statuses = append(statuses, HotKeyStatus{URL: url, Rate: rate})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Rate > statuses[j].Rate
+	})
+	if len(statuses) > n {
+		statuses = statuses[:n]
+	}
+	return statuses
+}
+
+// History returns the most recent hot episodes that have ended, oldest first
+func (hk *HotKeys) History() []HotKeyEpisode {
+	hk.mutex.Lock()
+	defer hk.mutex.Unlock()
+	return append(make([]HotKeyEpisode, 0, len(hk.history)), hk.history...)
+}
+
+// hotKeyHeap orders URLs by decayed count, coldest first. All counts decay at
+// the same rate, so ln(count) + lambda*t orders them as of any time.
+type hotKeyHeap struct {
+	keys   []*hotKey
+	lambda float64
+}
+
+func (h *hotKeyHeap) score(i int) float64 {
+	entry := h.keys[i].entry
+	return math.Log(entry.Count) + h.lambda*(float64)(entry.Updated)/float64(time.Second)
+}
+
+func (h *hotKeyHeap) Len() int           { return len(h.keys) }
+func (h *hotKeyHeap) Less(i, j int) bool { return h.score(i) < h.score(j) }
+func (h *hotKeyHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.keys[i].index = i
+	h.keys[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x any) {
+	key := x.(*hotKey)
+	key.index = len(h.keys)
+	h.keys = append(h.keys, key)
+}
+
+func (h *hotKeyHeap) Pop() any {
+	key := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	return key
+}
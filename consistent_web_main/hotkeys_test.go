@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHotKeyEntryDecay(t *testing.T) {
+	halfLife := 2 * time.Second
+	lambda := decayRate(halfLife)
+	entry := HotKeyEntry{Count: 8, Updated: 0}
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 8},
+		{-time.Second, 8},
+		{halfLife, 4},
+		{2 * halfLife, 2},
+		{3 * halfLife, 1},
+	}
+	for _, test := range tests {
+		if got := entry.at(int64(test.elapsed), lambda); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("count after %v = %v, want %v", test.elapsed, got, test.want)
+		}
+	}
+
+	// A request recorded out of order is counted at the entry's time
+	recorded := entry.record(-int64(time.Second), lambda)
+	if recorded.Count != 9 || recorded.Updated != 0 {
+		t.Errorf("out of order record = %+v, want count 9 at 0", recorded)
+	}
+}
+
+func TestHotKeysSteadyRate(t *testing.T) {
+	halfLife := time.Second
+	hk := Keys(10, 256, 4)
+	start := time.Unix(0, 0)
+	var rate float64
+	// 100 requests per second for 20 half-lives
+	for i := 0; i < 2000; i++ {
+		rate = hk.Record("http://example.com/", start.Add(time.Duration(i)*10*time.Millisecond), halfLife, math.Inf(1))
+	}
+	if rate < 95 || rate > 105 {
+		t.Errorf("rate = %v, want about 100", rate)
+	}
+}
+
+func TestHotKeysAdmission(t *testing.T) {
+	halfLife := time.Minute
+	now := time.Unix(0, 0)
+	hk := Keys(2, 1024, 4)
+	record := func(url string, n int) {
+		for i := 0; i < n; i++ {
+			hk.Record(url, now, halfLife, math.Inf(1))
+		}
+	}
+	tests := []struct {
+		url   string
+		count int
+		want  []string
+	}{
+		// The heap fills up first
+		{"a", 10, []string{"a"}},
+		{"b", 5, []string{"a", "b"}},
+		// A colder URL does not replace the coldest entry
+		{"c", 3, []string{"a", "b"}},
+		// Once its sketch estimate beats the coldest entry it does
+		{"c", 5, []string{"a", "c"}},
+	}
+	for _, test := range tests {
+		record(test.url, test.count)
+		top := hk.Top(10, now, halfLife)
+		if len(top) != len(test.want) {
+			t.Fatalf("after %d requests for %s: top = %v, want %v", test.count, test.url, top, test.want)
+		}
+		for i, url := range test.want {
+			if top[i].URL != url {
+				t.Fatalf("after %d requests for %s: top = %v, want %v", test.count, test.url, top, test.want)
+			}
+		}
+	}
+}
+
+func TestHotKeysEpisodes(t *testing.T) {
+	halfLife := time.Second
+	hk := Keys(10, 256, 4)
+	start := time.Unix(0, 0)
+	url := "http://example.com/"
+	// 100 requests per second make the URL hot at a threshold of 50
+	var now time.Time
+	for i := 0; i < 1000; i++ {
+		now = start.Add(time.Duration(i) * 10 * time.Millisecond)
+		hk.Record(url, now, halfLife, 50)
+	}
+	top := hk.Top(1, now, halfLife)
+	if len(top) != 1 || top[0].HotSince.IsZero() {
+		t.Fatalf("top = %v, want %s hot", top, url)
+	}
+	if len(hk.History()) != 0 {
+		t.Fatalf("history = %v, want no ended episode", hk.History())
+	}
+
+	// After ten quiet half-lives the next request ends the episode
+	hk.Record(url, now.Add(10*halfLife), halfLife, 50)
+	history := hk.History()
+	if len(history) != 1 || history[0].URL != url || history[0].PeakRate < 50 {
+		t.Fatalf("history = %v, want one episode of %s peaking above 50", history, url)
+	}
+}
+
+func TestProcessHotKeysLimit(t *testing.T) {
+	config := DefaultConfig()
+	main := newTestMain(t, config)
+	now := time.Now()
+	for _, url := range []string{"a", "b", "c"} {
+		main.hotKeys.Record(url, now, config.HotKeyHalfLife, config.HotKeyThreshold)
+	}
+
+	tests := []struct {
+		n       string
+		status  int
+		reports int
+	}{
+		{"", http.StatusOK, 3},
+		{"2", http.StatusOK, 2},
+		{"100000000000", http.StatusOK, 3},
+		{"0", http.StatusBadRequest, 0},
+		{"-1", http.StatusBadRequest, 0},
+		{"x", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		main.processHotKeys(w, httptest.NewRequest(http.MethodGet, "/hotkeys?n="+test.n, nil))
+		if w.Code != test.status {
+			t.Errorf("n=%q status = %d, want %d", test.n, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			HotKeys []hotKeyReport `json:"hot_keys"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.HotKeys) != test.reports {
+			t.Errorf("n=%q reports = %d, want %d", test.n, len(body.HotKeys), test.reports)
+		}
+	}
+}
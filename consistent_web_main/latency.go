@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Latency histograms use HDR-style log-linear buckets: values below
+// latencySubBuckets nanoseconds get a bucket each, and every further doubling
+// is split into latencySubBuckets/2 buckets, so a recorded value is off by
+// less than 1% while the histogram stays a few thousand counters in size.
+const (
+	latencySubBucketBits = 8
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyHalfBuckets   = latencySubBuckets / 2
+	// maxLatency is the largest latency tracked, larger ones are clamped to it
+	maxLatency = time.Hour
+)
+
+func latencyBucket(nanos uint64) int {
+	if nanos < latencySubBuckets {
+		return int(nanos)
+	}
+	exponent := bits.Len64(nanos) - latencySubBucketBits
+	return exponent*latencyHalfBuckets + int(nanos>>exponent)
+}
+
+// latencyBucketRange returns the smallest value and the number of values
+// counted by a bucket
+func latencyBucketRange(bucket int) (uint64, uint64) {
+	if bucket < latencySubBuckets {
+		return uint64(bucket), 1
+	}
+	exponent := bucket/latencyHalfBuckets - 1
+	sub := bucket - exponent*latencyHalfBuckets
+	return uint64(sub) << exponent, 1 << exponent
+}
+
+// LatencyHistogram counts latencies in nanoseconds since Start
+type LatencyHistogram struct {
+	counts []uint64
+	total  uint64
+	sum    float64
+	min    uint64
+	max    uint64
+	Start  time.Time
+}
+
+func NewLatencyHistogram(start time.Time) *LatencyHistogram {
+	return &LatencyHistogram{
+		counts: make([]uint64, latencyBucket(uint64(maxLatency))+1),
+		min:    math.MaxUint64,
+		Start:  start,
+	}
+}
+
+func (h *LatencyHistogram) record(latency time.Duration) {
+	nanos := uint64(max(latency, 0))
+	nanos = min(nanos, uint64(maxLatency))
+	h.counts[latencyBucket(nanos)]++
+	h.total++
+	h.sum += float64(nanos)
+	h.min = min(h.min, nanos)
+	h.max = max(h.max, nanos)
+}
+
+// Percentile returns the latency at or below which p percent of the recorded
+// latencies fall, rounded up to the end of its bucket
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(h.total)))
+	if target == 0 {
+		return time.Duration(h.min)
+	}
+	var cumulative uint64
+	for bucket, count := range h.counts {
+		cumulative += count
+		if cumulative >= target {
+			lowest, width := latencyBucketRange(bucket)
+			return time.Duration(min(lowest+width-1, h.max))
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// LatencySummary is the JSON form of a histogram, with latencies in nanoseconds
+type LatencySummary struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count uint64    `json:"count"`
+	Min   int64     `json:"min_ns"`
+	Mean  float64   `json:"mean_ns"`
+	P50   int64     `json:"p50_ns"`
+	P90   int64     `json:"p90_ns"`
+	P99   int64     `json:"p99_ns"`
+	P999  int64     `json:"p999_ns"`
+	Max   int64     `json:"max_ns"`
+}
+
+// fill sets the summary's count, mean and percentiles from histogram
+func (s *LatencySummary) fill(histogram *LatencyHistogram) {
+	s.Start = histogram.Start
+	s.Count = histogram.total
+	if histogram.total == 0 {
+		return
+	}
+	s.Min = int64(histogram.min)
+	s.Mean = histogram.sum / float64(histogram.total)
+	s.P50 = histogram.Percentile(50).Nanoseconds()
+	s.P90 = histogram.Percentile(90).Nanoseconds()
+	s.P99 = histogram.Percentile(99).Nanoseconds()
+	s.P999 = histogram.Percentile(99.9).Nanoseconds()
+	s.Max = int64(histogram.max)
+}
+
+// WriteRaw writes one latency in nanoseconds per line, the format read by
+// evaluation_scripts/generate_latency_metrics.py. Latencies are written as the
+// middle of their bucket, in increasing order.
+func (h *LatencyHistogram) WriteRaw(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	for bucket, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		lowest, width := latencyBucketRange(bucket)
+		value := min(max(lowest+(width-1)/2, h.min), h.max)
+		for i := uint64(0); i < count; i++ {
+			if _, err := fmt.Fprintf(buffered, "%v\n", value); err != nil {
+				return err
+			}
+		}
+	}
+	return buffered.Flush()
+}
+
+// Latencies records the router's routing latencies in memory
+type Latencies struct {
+	histogram *LatencyHistogram
+	mutex     sync.Mutex
+}
+
+func NewLatencies() *Latencies {
+	return &Latencies{histogram: NewLatencyHistogram(time.Now())}
+}
+
+// Record counts one routing latency
+func (l *Latencies) Record(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.histogram.record(latency)
+}
+
+// Snapshot returns a copy of the latencies recorded since the last reset
+func (l *Latencies) Snapshot() *LatencyHistogram {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	snapshot := *l.histogram
+	snapshot.counts = append([]uint64(nil), l.histogram.counts...)
+	return &snapshot
+}
+
+// Reset starts a new histogram and returns the latencies recorded since the
+// last reset
+func (l *Latencies) Reset() *LatencyHistogram {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	previous := l.histogram
+	l.histogram = NewLatencyHistogram(time.Now())
+	return previous
+}
+
+// writeLatencies responds with histogram as a JSON summary, or as a raw dump
+// when the format query parameter is raw
+func writeLatencies(w http.ResponseWriter, r *http.Request, histogram *LatencyHistogram, end time.Time) {
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		summary := LatencySummary{End: end}
+		summary.fill(histogram)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	case "raw":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		histogram.WriteRaw(w)
+	default:
+		http.Error(w, "Format must be json or raw", http.StatusBadRequest)
+	}
+}
+
+// processLatency reports the routing latencies recorded since the last reset
+func (main Main) processLatency(w http.ResponseWriter, r *http.Request) {
+	writeLatencies(w, r, main.latencies.Snapshot(), time.Now())
+}
+
+// processLatencyReset ends the current measurement interval, responding with
+// the latencies recorded during it and starting a new one
+func (main Main) processLatencyReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !main.authorize(w, r, RoleAdmin) {
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" && format != "raw" {
+		// Check before resetting so a bad request does not lose the interval
+		http.Error(w, "Format must be json or raw", http.StatusBadRequest)
+		return
+	}
+
+	writeLatencies(w, r, main.latencies.Reset(), time.Now())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	tests := []struct {
+		nanos  uint64
+		bucket int
+		lowest uint64
+		width  uint64
+	}{
+		{0, 0, 0, 1},
+		{1, 1, 1, 1},
+		{255, 255, 255, 1},
+		{256, 256, 256, 2},
+		{257, 256, 256, 2},
+		{258, 257, 258, 2},
+		{511, 383, 510, 2},
+		{512, 384, 512, 4},
+		{1000, 506, 1000, 4},
+	}
+	for _, test := range tests {
+		bucket := latencyBucket(test.nanos)
+		lowest, width := latencyBucketRange(bucket)
+		if bucket != test.bucket || lowest != test.lowest || width != test.width {
+			t.Errorf("%v ns: bucket %v [%v, +%v), want bucket %v [%v, +%v)",
+				test.nanos, bucket, lowest, width, test.bucket, test.lowest, test.width)
+		}
+	}
+}
+
+func TestLatencyBucketsContiguous(t *testing.T) {
+	// Every bucket starts where the previous one ends and is less than 1%
+	// wide once values no longer get a bucket each
+	last := latencyBucket(uint64(maxLatency))
+	next := uint64(0)
+	for bucket := 0; bucket <= last; bucket++ {
+		lowest, width := latencyBucketRange(bucket)
+		if lowest != next {
+			t.Fatalf("bucket %v starts at %v, want %v", bucket, lowest, next)
+		}
+		if latencyBucket(lowest) != bucket || latencyBucket(lowest+width-1) != bucket {
+			t.Fatalf("bucket %v [%v, +%v) does not hold its own range", bucket, lowest, width)
+		}
+		if lowest >= latencySubBuckets && float64(width)/float64(lowest) >= 0.01 {
+			t.Fatalf("bucket %v [%v, +%v) is 1%% wide or more", bucket, lowest, width)
+		}
+		next = lowest + width
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	histogram := NewLatencyHistogram(time.Unix(0, 0))
+	// 1µs to 100µs in steps of 1µs
+	for i := 1; i <= 100; i++ {
+		histogram.record(time.Duration(i) * time.Microsecond)
+	}
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{50, 50 * time.Microsecond},
+		{90, 90 * time.Microsecond},
+		{99, 99 * time.Microsecond},
+		{100, 100 * time.Microsecond},
+	}
+	for _, test := range tests {
+		got := histogram.Percentile(test.p)
+		// Percentiles are rounded up to the end of their bucket
+		if got < test.want || float64(got-test.want) > 0.01*float64(test.want) {
+			t.Errorf("p%v = %v, want %v within 1%%", test.p, got, test.want)
+		}
+	}
+	if got := NewLatencyHistogram(time.Unix(0, 0)).Percentile(50); got != 0 {
+		t.Errorf("p50 of an empty histogram = %v, want 0", got)
+	}
+
+	// Negative latencies count as 0 and larger ones than maxLatency as it
+	clamped := NewLatencyHistogram(time.Unix(0, 0))
+	clamped.record(-time.Second)
+	clamped.record(2 * maxLatency)
+	if low, high := clamped.Percentile(0), clamped.Percentile(100); low != 0 || high != maxLatency {
+		t.Errorf("clamped p0, p100 = %v, %v, want 0, %v", low, high, maxLatency)
+	}
+}
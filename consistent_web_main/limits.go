@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenBucket limits the rate of requests while allowing short bursts. The
+// rate and burst are passed on every call so they follow config reloads.
+type TokenBucket struct {
+	tokens  float64
+	updated time.Time
+	mutex   sync.Mutex
+}
+
+// Allow refills the bucket at rate tokens per second up to burst and takes one
+// token if there is one
+func (b *TokenBucket) Allow(now time.Time, rate float64, burst int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.updated.IsZero() {
+		// A new bucket starts full
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+	// A request stamped earlier must not let the next one refill again
+	if now.After(b.updated) {
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// lastUsed returns when a token was last asked for
+func (b *TokenBucket) lastUsed() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.updated
+}
+
+// RateLimiter keeps a token bucket for every client
+type RateLimiter struct {
+	buckets map[string]*TokenBucket
+	mutex   sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*TokenBucket)}
+}
+
+// Allow takes a request from the client's bucket and reports whether it was
+// within the client's rate
+func (l *RateLimiter) Allow(client string, now time.Time, rate float64, burst int) bool {
+	l.mutex.Lock()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &TokenBucket{}
+		l.buckets[client] = bucket
+	}
+	l.mutex.Unlock()
+	return bucket.Allow(now, rate, burst)
+}
+
+// Prune forgets the clients that sent no request since before, whose buckets
+// would be full again anyway
+func (l *RateLimiter) Prune(before time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for client, bucket := range l.buckets {
+		if bucket.lastUsed().Before(before) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Size returns the number of clients tracked
+func (l *RateLimiter) Size() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// clientBurst returns the configured burst, one second of requests by default
+func clientBurst(config *Config) int {
+	if config.ClientRateBurst > 0 {
+		return config.ClientRateBurst
+	}
+	return int(math.Max(1, math.Ceil(config.ClientRateLimit)))
+}
+
+// clientKey identifies the client of a request: by its API key if the client
+// key header is configured and sent, else by its IP address
+func clientKey(r *http.Request, config *Config) string {
+	if config.ClientKeyHeader != "" {
+		if key := r.Header.Get(config.ClientKeyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// pruneRateLimits drops idle clients every minute so the limiter does not
+// grow with the number of clients ever seen
+func (main Main) pruneRateLimits() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		config := main.config.Load()
+		idle := time.Minute
+		if config.ClientRateLimit > 0 {
+			// A bucket refills completely in burst/rate seconds
+			refill := time.Duration(float64(clientBurst(config)) / config.ClientRateLimit * float64(time.Second))
+			idle = max(idle, refill)
+		}
+		main.rateLimiter.Prune(now.Add(-idle))
+	}
+}
+
+// Reasons requests are shed
+const (
+	ShedLoad     = "load"
+	ShedInFlight = "in_flight"
+)
+
+// LoadShedder rejects requests when the router or the cluster is overloaded.
+// The cluster's capacity is the live nodes times the configured per-node
+// capacity. When the estimated load, the rate of requests reaching the router
+// or the request rate the nodes report if higher, exceeds it, each request is
+// admitted with probability capacity/load so the admitted load stays near the
+// capacity.
+type LoadShedder struct {
+	// offered is the decayed count of every request that reached shedding
+	offered HotKeyEntry
+	mutex   sync.Mutex
+	// capacity and clusterRate hold float64 bits, updated every second
+	capacity    atomic.Uint64
+	clusterRate atomic.Uint64
+	inFlight    atomic.Int64
+}
+
+func NewLoadShedder() *LoadShedder {
+	return &LoadShedder{}
+}
+
+// Admit decides whether a request arriving at now is served. It returns the
+// reason it is shed otherwise.
+func (s *LoadShedder) Admit(now time.Time, config *Config) (bool, string) {
+	s.mutex.Lock()
+	lambda := decayRate(config.HotKeyHalfLife)
+	offered := s.offered.at(now.UnixNano(), lambda) * lambda
+	s.offered = s.offered.record(now.UnixNano(), lambda)
+	s.mutex.Unlock()
+
+	if config.ShedMaxInFlight > 0 && s.inFlight.Load() >= int64(config.ShedMaxInFlight) {
+		return false, ShedInFlight
+	}
+	capacity := s.Capacity()
+	if config.ShedNodeCapacity <= 0 || capacity <= 0 {
+		return true, ""
+	}
+	load := math.Max(offered, s.ClusterRate())
+	if load > capacity && rand.Float64() > capacity/load {
+		return false, ShedLoad
+	}
+	return true, ""
+}
+
+// Update sets the capacity of the liveNodes and the request rate last reported
+// by the nodes
+func (s *LoadShedder) Update(liveNodes int, clusterRate float64, config *Config) {
+	s.capacity.Store(math.Float64bits(float64(liveNodes) * config.ShedNodeCapacity))
+	s.clusterRate.Store(math.Float64bits(clusterRate))
+}
+
+// Capacity returns the requests per second the live nodes can serve, 0 when
+// shedding by load is off
+func (s *LoadShedder) Capacity() float64 {
+	return math.Float64frombits(s.capacity.Load())
+}
+
+// ClusterRate returns the request rate the nodes last reported
+func (s *LoadShedder) ClusterRate() float64 {
+	return math.Float64frombits(s.clusterRate.Load())
+}
+
+// Load returns the estimated load in requests per second as of now
+func (s *LoadShedder) Load(now time.Time, config *Config) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lambda := decayRate(config.HotKeyHalfLife)
+	return math.Max(s.offered.at(now.UnixNano(), lambda)*lambda, s.ClusterRate())
+}
+
+// Begin counts a request the router starts handling and returns the function
+// that counts it as done
+func (s *LoadShedder) Begin() func() {
+	s.inFlight.Add(1)
+	return func() { s.inFlight.Add(-1) }
+}
+
+// InFlight returns the number of requests the router is handling
+func (s *LoadShedder) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// trackLoad updates the capacity of the cluster every second from the live
+// nodes and the request rate of the latest cluster metrics scrape, ignoring
+// scrapes that are too old to describe the current load
+func (main Main) trackLoad() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		config := main.config.Load()
+		clusterRate := 0.0
+		if cluster := main.cluster.Load(); cluster != nil && now.Sub(cluster.Updated) <= 2*config.ClusterMetricsInterval {
+			clusterRate = cluster.RequestRate
+		}
+		main.shedder.Update(main.membership.LiveCount(config.HeartbeatTimeout), clusterRate, config)
+	}
+}
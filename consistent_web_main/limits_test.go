@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		// offsets of the requests from start and whether each is allowed
+		at   []time.Duration
+		want []bool
+	}{
+		{"starts full", 1, 3,
+			[]time.Duration{0, 0, 0, 0},
+			[]bool{true, true, true, false}},
+		{"refills at the rate", 2, 1,
+			[]time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond, 600 * time.Millisecond, time.Second},
+			[]bool{true, false, false, true, false, true}},
+		{"refills up to the burst", 10, 2,
+			[]time.Duration{0, 0, 0, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+			[]bool{true, true, false, true, true, false}},
+		{"ignores time going backwards", 1, 1,
+			[]time.Duration{time.Second, 0, 0, time.Second},
+			[]bool{true, false, false, false}},
+		{"fractional rate", 0.5, 1,
+			[]time.Duration{0, time.Second, 2 * time.Second},
+			[]bool{true, false, true}},
+	}
+	for _, test := range tests {
+		bucket := &TokenBucket{}
+		for i, offset := range test.at {
+			if got := bucket.Allow(start.Add(offset), test.rate, test.burst); got != test.want[i] {
+				t.Errorf("%s: request %d at %v allowed = %v, want %v", test.name, i, offset, got, test.want[i])
+			}
+		}
+	}
+}
@@ -1,87 +1,152 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
-	"math"
-	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"urlnorm"
 	"web_main/consistent_hash"
+	"web_main/gossip"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var (
-	latencyFile *os.File
-	fileMutex   sync.Mutex
-	latencyFileName string
-)
-
 type Main struct {
-	mainPort       int
-	nodeAddresses  []string
-	nodeMap        map[string]consistent_hash.ServerNode
-	consistentHash *consistent_hash.Trie
-}
-
-type HotKeyEntry struct {
-	Average         float64
-	PastTimeRequest int64
-}
-
-type HotKeys struct {
-	KeyMap map[string]HotKeyEntry
-	mutex  sync.RWMutex
+	// config is replaced as a whole on reload so handlers always see a consistent set of settings
+	config        *atomic.Pointer[Config]
+	configArgs    []string
+	reloadMutex   *sync.Mutex
+	membership    *Membership
+	hotKeys       *HotKeys
+	namespaces    *Namespaces
+	rateLimiter   *RateLimiter
+	shedder       *LoadShedder
+	responseTimes *ResponseTimes
+	capacity      *Capacity
+	inFlight      *InFlight
+	metrics       *Metrics
+	latencies     *Latencies
+	health        *Health
+	cluster       *atomic.Pointer[ClusterMetrics]
+	client        *http.Client
+	audit         *AuditLog
+	replication   *Replication     // nil unless Raft replication is configured
+	gossip        *gossip.Observer // nil unless gossip membership is configured
+	tlsConfig     *tls.Config      // nil unless the TLS listener is enabled
+	logger        *zap.Logger
+	logLevel      zap.AtomicLevel
 }
 
-func Keys() *HotKeys {
-	return &HotKeys{
-		KeyMap: make(map[string]HotKeyEntry),
+// NewMain creates the router from config. configArgs are the command-line
+// arguments config was loaded from and are read again on every reload.
+func NewMain(config Config, configArgs []string) (*Main, error) {
+	main := Main{
+		config:      &atomic.Pointer[Config]{},
+		configArgs:  configArgs,
+		reloadMutex: &sync.Mutex{},
 	}
-}
-
-// Get retrieves a cached entry by key
-func (c *HotKeys) Get(url string) (HotKeyEntry, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	entry, ok := c.KeyMap[url]
-	return entry, ok
-}
+	main.config.Store(&config)
 
-// Set inserts or updates a cached entry
-func (hk *HotKeys) Set(url string, entry HotKeyEntry) {
-	hk.mutex.Lock()
-	defer hk.mutex.Unlock()
-	hk.KeyMap[url] = entry
-}
+	level, err := zapcore.ParseLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	main.logger, main.logLevel = newLogger(level)
 
-func NewMain(mainPort int, nodeList []consistent_hash.ServerNode) *Main {
-	main := Main{mainPort: mainPort}
+	main.audit, err = OpenAuditLog(config.AuditLogFile, main.logger.Named("audit"))
+	if err != nil {
+		return nil, err
+	}
 
-	nodeMap := make(map[string]consistent_hash.ServerNode)
-	for _, node := range nodeList {
-		nodeMap[node.IP] = node
-		main.nodeAddresses = append(main.nodeAddresses, node.IP)
+	// Initialize for time.Now() + 60 seconds to allow for starting everything up
+	timestamp := time.Now().Add(60 * time.Second)
+	nodeList := make([]consistent_hash.ServerNode, 0, len(config.Nodes))
+	for _, node := range config.Nodes {
+		nodeList = append(nodeList, consistent_hash.ServerNode{ID: node.ID, Addr: node.Addr, Timestamp: timestamp, Replicas: node.Replicas})
 	}
-	main.nodeMap = nodeMap
 
-	main.consistentHash = consistent_hash.NewTrie(nodeMap)
+	membership, err := NewMembership(config.RingAlgorithm, nodeList, main.audit)
+	if err != nil {
+		return nil, err
+	}
+	main.membership = membership
+	if config.RaftID != "" {
+		membership.replicated = true
+		if main.replication, err = NewReplication(main.config.Load(), membership, main.logger.Named("raft")); err != nil {
+			return nil, err
+		}
+	}
+	if config.GossipBind != "" {
+		name := config.GossipName
+		if name == "" {
+			name = fmt.Sprintf("router-%d", config.Port)
+		}
+		gossipLogger, err := zap.NewStdLogAt(main.logger.Named("gossip"), zapcore.DebugLevel)
+		if err != nil {
+			return nil, err
+		}
+		// Validate has checked the key
+		key, _ := gossip.ParseKey(config.GossipKey)
+		if main.gossip, err = gossip.NewObserver(name, config.GossipBind, config.GossipJoin, key, gossipLogger); err != nil {
+			return nil, err
+		}
+	}
+	main.hotKeys = Keys(config.HotKeyCapacity, config.HotKeySketchWidth, config.HotKeySketchDepth)
+	main.namespaces = NewNamespaces(main.hotKeys)
+	main.rateLimiter = NewRateLimiter()
+	main.shedder = NewLoadShedder()
+	main.responseTimes = NewResponseTimes()
+	membership.SetNamespaces(config.NamespaceAssignments())
+	main.capacity = NewCapacity(config.HotKeyThreshold)
+	main.health = NewHealth()
+	main.inFlight = &InFlight{}
+	main.metrics = NewMetrics()
+	main.latencies = NewLatencies()
+	main.cluster = &atomic.Pointer[ClusterMetrics]{}
+	// The timeout bounds proxied requests, probes and scrapes use shorter deadlines
+	main.client = &http.Client{Timeout: config.ProxyTimeout}
+	if config.TLSPort != 0 {
+		if main.tlsConfig, err = tlsConfig(&config); err != nil {
+			return nil, err
+		}
+	}
 
-	return &main
+	return &main, nil
 }
 
-func (main Main) updateNodeTimestamps(node string, w http.ResponseWriter) {
-	nodeData, exists := main.nodeMap[node]
-	if !exists {
-		http.Error(w, "Node does not exist", http.StatusBadRequest)
-		return
+func newLogger(level zapcore.Level) (*zap.Logger, zap.AtomicLevel) {
+	// Create logger configuration with asynchronous logging enabled
+	cfg := zap.Config{
+		Level:       zap.NewAtomicLevelAt(level),
+		Development: true,
+		Encoding:    "json",
+		EncoderConfig: zapcore.EncoderConfig{
+			TimeKey:        "time",
+			LevelKey:       "level",
+			NameKey:        "logger",
+			CallerKey:      "caller",
+			MessageKey:     "msg",
+			StacktraceKey:  "stacktrace",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.CapitalLevelEncoder,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		},
+		OutputPaths:      []string{"stdout"},
+		ErrorOutputPaths: []string{"stderr"},
 	}
-	nodeData.Timestamp = time.Now()
-	main.nodeMap[node] = nodeData
+
+	logger, _ := cfg.Build()
+	return logger, cfg.Level
 }
 
 func (main Main) processHeartbeat(w http.ResponseWriter, r *http.Request) {
@@ -90,158 +155,308 @@ func (main Main) processHeartbeat(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
-	// Get the port from the form data
-	ip_address, _, err := net.SplitHostPort(r.RemoteAddr)
-
-	if err != nil || ip_address == "" {
-		http.Error(w, "Cannot get IP address", http.StatusBadRequest)
+	// Get the node identity from the form data
+	id := r.Form.Get("id")
+	addr := r.Form.Get("addr")
+	if id == "" {
+		http.Error(w, "Missing node id", http.StatusBadRequest)
 		return
 	}
-	if ip_address == "::1" {
-		ip_address = "localhost" // localhost or 127.0.0.1 is equivalent to ::1
+	if addr != "" && !validNodeAddr(addr) {
+		http.Error(w, "Node address must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	// Heartbeats are not authenticated, so a node that advertises another
+	// address is refused rather than moved. Addresses are changed through
+	// the admin API.
+	if node, ok := main.membership.Node(id); ok && addr != "" && node.Addr != addr {
+		main.logger.Warn("Heartbeat advertised a different address", zap.String("node", id),
+			zap.String("addr", node.Addr), zap.String("advertised", addr), zap.String("remote_addr", r.RemoteAddr))
+		http.Error(w, "Node address does not match, change it with PUT /admin/nodes/{id}/addr", http.StatusConflict)
+		return
 	}
 
 	// Process the heartbeat (for example, you can log it)
-	fmt.Printf("Received heartbeat from node %s\n", ip_address)
-	main.updateNodeTimestamps(ip_address, w)
+	fmt.Printf("Received heartbeat from node %s (%s)\n", id, addr)
+	if !main.membership.Heartbeat(id) {
+		http.Error(w, "Node does not exist", http.StatusBadRequest)
+		return
+	}
 
 	// Respond with a success message
 	w.WriteHeader(http.StatusOK)
 }
 
-func (main Main) processInsert(w http.ResponseWriter, r *http.Request) {
-	// Get the port from the form data
-	ip_address, _, err := net.SplitHostPort(r.RemoteAddr)
+// validNodeAddr reports whether addr is a host:port pair usable as a node's
+// advertised address.
+func validNodeAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != ""
+}
 
-	if err != nil || ip_address != "::1" {
-		http.Error(w, "Cannot identify valid host", http.StatusBadRequest)
+// nodeURL returns the URL on the given node that serves target.
+func nodeURL(node consistent_hash.ServerNode, target string) string {
+	return fmt.Sprintf("http://%v/?url=%v", node.Addr, url.QueryEscape(target))
+}
+
+func (main Main) processInsert(w http.ResponseWriter, r *http.Request) {
+	if !main.authorize(w, r, RoleAdmin) {
 		return
 	}
 
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
 
-	new_node_ip_address := r.Form.Get("ip_address")
+	new_node_id := r.Form.Get("id")
+	new_node_addr := r.Form.Get("addr")
 	new_node_replica_count := r.Form.Get("replica_count")
-	if new_node_ip_address == "" || new_node_replica_count == "" {
+	if new_node_id == "" || new_node_addr == "" || new_node_replica_count == "" {
 		http.Error(w, "Some parameter is missing", http.StatusBadRequest)
 		return
 	}
+	if !validNodeAddr(new_node_addr) {
+		http.Error(w, "Node address must be host:port", http.StatusBadRequest)
+		return
+	}
 	new_node_replica_count_int, err := strconv.Atoi(new_node_replica_count)
 	if err != nil {
 		http.Error(w, "Error parsing replica count", http.StatusBadRequest)
 		return
 	}
+	if new_node_replica_count_int <= 0 {
+		http.Error(w, "Replica count must be greater than 0", http.StatusBadRequest)
+		return
+	}
 
-	main.consistentHash.InsertNode(new_node_ip_address, new_node_replica_count_int)
-
-	// Process the heartbeat (for example, you can log it)
-	fmt.Printf("Inserted new node %s\n", ip_address)
+	cmd := membershipCommand{Op: opInsert, ID: new_node_id, Addr: new_node_addr, Replicas: new_node_replica_count_int,
+		Actor: main.caller(r), Reason: r.Form.Get("reason")}
+	if _, err := main.applyChange(cmd); err != nil {
+		main.changeError(w, r, err)
+		return
+	}
 
 	// Respond with a success message
 	w.WriteHeader(http.StatusOK)
 }
 
 func (main Main) processDelete(w http.ResponseWriter, r *http.Request) {
-	// Get the port from the form data
-	ip_address, _, err := net.SplitHostPort(r.RemoteAddr)
-
-	if err != nil || ip_address != "::1" {
-		http.Error(w, "Cannot identify valid host", http.StatusBadRequest)
+	if !main.authorize(w, r, RoleAdmin) {
 		return
 	}
 
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
 
-	remove_ip_address := r.Form.Get("ip_address")
-	if remove_ip_address == "" {
+	remove_id := r.Form.Get("id")
+	if remove_id == "" {
 		http.Error(w, "Some parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	main.consistentHash.DeleteNode(remove_ip_address)
-
-	// Process the heartbeat (for example, you can log it)
-	fmt.Printf("Deleted node %s\n", ip_address)
+	known, err := main.applyChange(membershipCommand{Op: opDelete, ID: remove_id, Actor: main.caller(r), Reason: r.Form.Get("reason")})
+	if err != nil {
+		main.changeError(w, r, err)
+		return
+	}
+	if !known {
+		http.Error(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
 
 	// Respond with a success message
 	w.WriteHeader(http.StatusOK)
 }
 
-func recordLatency(latency time.Duration) {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
-	_, err := latencyFile.WriteString(fmt.Sprintf("%v\n", latency.Nanoseconds()))
-	if err != nil {
-		fmt.Println("Error writing to file:", err)
-	}
+type hotKeyReport struct {
+	URL           string   `json:"url"`
+	Rate          float64  `json:"rate"`
+	Dispersed     bool     `json:"dispersed"`
+	Nodes         []string `json:"nodes"`
+	HotForSeconds float64  `json:"hot_for_seconds"`
 }
 
-func init() {
-	latencyFileName = time.Now().String() + ".txt"
-	var err error
-	latencyFile, err = os.OpenFile(latencyFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		os.Exit(1)
+// processHotKeys reports the hottest URLs of a namespace with their decayed
+// request rates, the nodes currently serving each one and the recent hot
+// episodes. The number of URLs is given by the optional n query parameter and
+// the namespace by the optional namespace parameter.
+func (main Main) processHotKeys(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Error parsing n", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	config := main.config.Load()
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		name = DefaultNamespace
+	}
+	namespace, ok := config.Namespace(name)
+	if !ok {
+		http.Error(w, "Unknown namespace", http.StatusNotFound)
+		return
+	}
+	hotKeys := main.namespaces.HotKeys(namespace.Name, config)
+	threshold, maxReplicas := main.hotKeySettings(namespace, config)
+	now := time.Now()
+	// n is not bounded, so the reports are sized by the tracked keys Top returns
+	statuses := hotKeys.Top(n, now, config.HotKeyHalfLife)
+	reports := make([]hotKeyReport, 0, len(statuses))
+	for _, status := range statuses {
+		report := hotKeyReport{URL: status.URL, Rate: status.Rate, Nodes: make([]string, 0)}
+		replicas := 1
+		if status.Rate >= threshold {
+			report.Dispersed = true
+			replicas = hotReplicaCount(status.Rate, threshold, maxReplicas)
+			if !status.HotSince.IsZero() {
+				report.HotForSeconds = now.Sub(status.HotSince).Seconds()
+			}
+		}
+		for _, node := range main.membership.Owners(namespace.Name, status.URL, replicas, config.HeartbeatTimeout) {
+			report.Nodes = append(report.Nodes, node.ID)
+		}
+		reports = append(reports, report)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"namespace":     namespace.Name,
+		"threshold":     threshold,
+		"adaptive":      config.AdaptiveThresholdFraction > 0 && namespace.HotKeyThreshold == 0,
+		"node_capacity": main.capacity.NodeCapacity(),
+		"hot_keys":      reports,
+		"history":       hotKeys.History(),
+	})
 }
 
-func saveAndCloseFile() {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
-	err := latencyFile.Close()
+// processURL routes a request for url to its cache node. Requests the router
+// received as a forward proxy are always proxied, since a client expecting the
+// origin's response cannot follow a redirect to a cache node.
+func (main Main) processURL(w http.ResponseWriter, r *http.Request, url string, proxied bool) {
+	now := time.Now()
+
+	// Settings are loaded once so a concurrent reload cannot mix old and new values
+	config := main.config.Load()
+
+	// Hash, count and forward the canonical URL so every spelling of it
+	// reaches the same node and is cached once
+	url, err := urlnorm.New(config.URLStripParams).Normalize(url)
 	if err != nil {
-		fmt.Println("Error closing file:", err)
+		http.Error(w, fmt.Sprintf("Invalid URL: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// A single noisy client is limited before it uses up its namespace's quota
+	if config.ClientRateLimit > 0 && !main.rateLimiter.Allow(clientKey(r, config), now, config.ClientRateLimit, clientBurst(config)) {
+		main.metrics.RecordRateLimited()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Client rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
-	// Reopen the file for further writing
-	latencyFile, err = os.OpenFile(latencyFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	// Each namespace has its own ring, hot keys and quota
+	namespace, err := selectNamespace(r, config)
 	if err != nil {
-		fmt.Println("Error reopening file:", err)
-		os.Exit(1)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
-}
+	if !main.namespaces.Allow(namespace, now) {
+		main.metrics.RecordNamespace(namespace.Name, true)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Namespace quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+	main.metrics.RecordNamespace(namespace.Name, false)
 
-func (main Main) serve() {
+	// Shed load the cluster cannot serve rather than overload every node
+	if ok, reason := main.shedder.Admit(now, config); !ok {
+		main.metrics.RecordShed(reason)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Cluster overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	done := main.shedder.Begin()
+	defer done()
+	threshhold, maxReplicas := main.hotKeySettings(namespace, config)
+
+	start_time := time.Now()
+	var node consistent_hash.ServerNode
+	found := false
+	dispersed := false
+	// Spread the URL over a few of its ring owners if url is hot
+	rate := main.namespaces.HotKeys(namespace.Name, config).Record(url, now, config.HotKeyHalfLife, threshhold)
+	if rate >= threshhold {
+		replicas := hotReplicaCount(rate, threshhold, maxReplicas)
+		if owners := main.membership.Owners(namespace.Name, url, replicas, config.HeartbeatTimeout); len(owners) > 0 {
+			node, found = main.pickHotNode(owners, config), true
+			dispersed = len(owners) > 1
+		}
+	}
 
-	// Create logger configuration with asynchronous logging enabled
-	cfg := zap.Config{
-		Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
-		Development: true,
-		Encoding:    "json",
-		EncoderConfig: zapcore.EncoderConfig{
-			TimeKey:        "time",
-			LevelKey:       "level",
-			NameKey:        "logger",
-			CallerKey:      "caller",
-			MessageKey:     "msg",
-			StacktraceKey:  "stacktrace",
-			LineEnding:     zapcore.DefaultLineEnding,
-			EncodeLevel:    zapcore.CapitalLevelEncoder,
-			EncodeTime:     zapcore.ISO8601TimeEncoder,
-			EncodeDuration: zapcore.StringDurationEncoder,
-			EncodeCaller:   zapcore.ShortCallerEncoder,
-		},
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stderr"},
+	mode := config.ForwardMode
+	if proxied {
+		mode = ForwardProxy
 	}
 
-	logger, _ := cfg.Build()
-	defer logger.Sync()
+	// Otherwise the URL goes to its live ring owner, or to a faster replica
+	// when proxying
+	diverted := false
+	if !found {
+		node, found = main.membership.Lookup(namespace.Name, url, config.HeartbeatTimeout)
+		if found && mode == ForwardProxy && config.LatencyReplicas > 1 {
+			if owners := main.membership.Owners(namespace.Name, url, config.LatencyReplicas, config.HeartbeatTimeout); len(owners) > 1 {
+				node, diverted = main.pickFastest(owners, now, config)
+			}
+		}
+	}
+	end_time := time.Now()
+	if !found {
+		main.metrics.RecordUnroutable()
+		http.Error(w, "No live nodes available", http.StatusServiceUnavailable)
+		return
+	}
 
-	// TODO figure out best threshold / k value
-	threshhold := 1000.0
-	k := 0.65
+	main.capacity.Record(now, config.HotKeyHalfLife)
+	main.metrics.RecordRouted(node.ID, dispersed, end_time.Sub(start_time))
+	if diverted {
+		main.metrics.RecordDiverted(node.ID)
+	}
+
+	// Send request to the found node
+	main.forward(w, r, node, url, mode)
+
+	latency := end_time.Sub(start_time)
+	main.latencies.Record(latency)
+}
+
+func (main Main) serve() {
+	logger := main.logger
+	defer logger.Sync()
 
-	hotUrls := Keys()
+	main.handleReloadSignals()
+	go main.trackCapacity()
+	go main.trackLoad()
+	go main.pruneRateLimits()
+	go main.pollCacheHotKeys()
+	go main.pollClusterMetrics()
+	go main.probeNodes()
+	if main.replication != nil {
+		go main.expireNodes()
+	}
+	if main.gossip != nil {
+		go main.followGossip()
+	}
 
 	// Start the heartbeat server
 	http.Handle("/heartbeat", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -256,86 +471,87 @@ func (main Main) serve() {
 		main.processDelete(w, r)
 	}))
 
+	http.Handle("/admin/reload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processReload(w, r)
+	}))
+
+	http.Handle("GET /ring", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processRingDiscovery(w, r)
+	}))
+
+	// JSON admin API
+	http.Handle("GET /admin/nodes", main.adminHandler(RoleRead, main.processListNodes))
+	http.Handle("GET /admin/nodes/{id}", main.adminHandler(RoleRead, main.processGetNode))
+	http.Handle("PUT /admin/nodes/{id}/weight", main.adminHandler(RoleAdmin, main.processSetWeight))
+	http.Handle("PUT /admin/nodes/{id}/state", main.adminHandler(RoleAdmin, main.processSetState))
+	http.Handle("PUT /admin/nodes/{id}/addr", main.adminHandler(RoleAdmin, main.processSetAddr))
+	http.Handle("GET /admin/ring", main.adminHandler(RoleRead, main.processRing))
+	http.Handle("GET /admin/namespaces", main.adminHandler(RoleRead, main.processNamespaces))
+	http.Handle("GET /admin/audit", main.adminHandler(RoleRead, main.processAudit))
+	http.Handle("GET /admin/raft", main.adminHandler(RoleRead, main.processRaft))
+
+	http.Handle("/hotkeys", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processHotKeys(w, r)
+	}))
+
+	http.Handle("/cluster/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processClusterMetrics(w, r)
+	}))
+
+	http.Handle("/latency", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processLatency(w, r)
+	}))
+
+	http.Handle("/admin/latency/reset", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processLatencyReset(w, r)
+	}))
+
+	http.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		main.processMetrics(w, r)
+	}))
+
 	// Start the main server
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		now := time.Now().Unix()
-
 		url := r.URL.Query().Get("url")
 		if url == "" {
 			http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
 			return
 		}
-		if url == "done" {
-			saveAndCloseFile()
-		}
-
-		start_time := time.Now()
-		ip := ""
-		// Find the IP address of the node that will serve the URL if url is hot
-		value, exists := hotUrls.Get(url)
-		if exists {
-			if value.Average >= threshhold {
-				//logger.Info("Threshold reached, randomly dispersing.")
-				ip = main.nodeAddresses[rand.Intn(len(main.nodeAddresses))]
-			} else {
-				ip = main.consistentHash.ValueLookup(url)
-			}
-
-			if value.PastTimeRequest == now {
-				logger.Info("Same request in current second, calculating moving average.")
-				hotUrls.Set(url, HotKeyEntry{
-					Average:         value.Average + 1,
-					PastTimeRequest: value.PastTimeRequest,
-				})
-			} else {
-				//logger.Info("Moving average update for time of different second.")
-
-				seconds := (float64)(now - value.PastTimeRequest)
-				newAverage := value.Average*math.Pow(k, seconds) + 1
-				hotUrls.Set(url, HotKeyEntry{
-					Average:         newAverage,
-					PastTimeRequest: now,
-				})
-			}
-		} else {
-			//logger.Info("Starting entry of moving average.")
-			ip = main.consistentHash.ValueLookup(url)
-			hotUrls.Set(url, HotKeyEntry{
-				Average:         1,
-				PastTimeRequest: now,
-			})
-		}
-
-		for time.Since(main.nodeMap[ip].Timestamp) > 15*time.Second {
-			main.consistentHash.DeleteNode(ip)
-			ip = main.consistentHash.ValueLookup(url)
-		}
-		end_time := time.Now()
-
-		// Send request to found ip address
-		http.Redirect(w, r, fmt.Sprintf("http://%v:5050?url=%v", ip, url), http.StatusTemporaryRedirect)
-
-		latency := end_time.Sub(start_time)
-		recordLatency(latency)
+		main.processURL(w, r, url, false)
 	})
 
-	serveAddr := fmt.Sprintf(":%d", main.mainPort)
+	config := main.config.Load()
+	if main.tlsConfig != nil {
+		server := &http.Server{Addr: fmt.Sprintf(":%d", config.TLSPort), TLSConfig: main.tlsConfig, Handler: main.proxyRequests(http.DefaultServeMux)}
+		go func() {
+			fmt.Println("TLS server started on ", server.Addr)
+			err := server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+			logger.Error("TLS server stopped", zap.Error(err))
+		}()
+	}
+
+	serveAddr := fmt.Sprintf(":%d", config.Port)
 	fmt.Println("Server started on ", serveAddr)
-	http.ListenAndServe(serveAddr, nil)
+	http.ListenAndServe(serveAddr, main.proxyRequests(http.DefaultServeMux))
 }
 
 func main() {
-	defer latencyFile.Close()
 	runTests := false
 	if runTests {
 		consistent_hash.CycleMain()
 		consistent_hash.KademliaMain()
 	} else {
-		// Initialize for time.Now() + 60 seconds to allow for starting everything up
-		timestamp := time.Now().Add(60 * time.Second)
-		// If using Google Cloud, change this variable to include the IPs of the servers you have created
-		nodeList := []consistent_hash.ServerNode{{IP: "localhost", Timestamp: timestamp, Replicas: 1}}
-		main := NewMain(8080, nodeList)
+		// If using Google Cloud, list the IDs and host:port addresses of the servers you have created in the config file
+		config, err := LoadConfig(os.Args[1:])
+		if err != nil {
+			fmt.Println("Error loading config:", err)
+			os.Exit(1)
+		}
+		main, err := NewMain(config, os.Args[1:])
+		if err != nil {
+			fmt.Println("Error creating main:", err)
+			os.Exit(1)
+		}
 		main.serve()
 	}
 }
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"web_main/consistent_hash"
+)
+
+// Membership tracks the cache nodes known to the router and keeps the ring in
+// sync with them. The ring keeps its own copy of the node map, so handlers
+// read node metadata from here without racing ring updates.
+type Membership struct {
+	algorithm string
+	nodes     map[string]consistent_hash.ServerNode
+	ring      consistent_hash.ConsistentHash
+	// draining holds the nodes taken out of the ring without being deleted
+	draining map[string]bool
+	audit    *AuditLog
+	// pending holds the audit records of changes made under the mutex.
+	// They are written after it is released, so lookups do not wait for
+	// the audit log's disk syncs. auditMutex keeps them in order.
+	pending    []AuditRecord
+	auditMutex sync.Mutex
+	// unhealthy holds the nodes failing their health probes. Like heartbeat
+	// timestamps it is local to each router.
+	unhealthy map[string]bool
+	// replicated is set when changes arrive through the Raft log. Lookup then
+	// leaves the ring alone so every router applies the same changes in the
+	// same order.
+	replicated bool
+	// version is incremented on every change to the ring
+	version uint64
+	// expired and removed count nodes deleted for missing heartbeats and by
+	// the admin commands
+	expired uint64
+	removed uint64
+	// shares caches RingShares for the ring version it was computed at
+	shares        map[string]float64
+	sharesVersion uint64
+	// namespaceOf assigns nodes to namespaces, nodes missing from it belong
+	// to the default namespace. Each namespace gets its own ring of its
+	// nodes, rebuilt when first used after a change.
+	namespaceOf      map[string]string
+	namespaceRings   map[string]namespaceRing
+	namespaceVersion uint64
+	namespaceMutex   sync.Mutex
+	mutex            sync.RWMutex
+}
+
+// namespaceRing is the ring of the nodes of one namespace
+type namespaceRing struct {
+	ring consistent_hash.ConsistentHash
+	size int
+}
+
+// States of a node in the membership. Draining nodes keep sending heartbeats
+// but are out of the ring, so they receive no requests.
+const (
+	NodeActive   = "active"
+	NodeDraining = "draining"
+)
+
+// ringShareSamples is the number of keys looked up to estimate ring shares
+const ringShareSamples = 10000
+
+// MembershipStats describes the ring as of the time it was read
+type MembershipStats struct {
+	Version uint64
+	Expired uint64
+	Removed uint64
+}
+
+func NewMembership(algorithm string, nodeList []consistent_hash.ServerNode, audit *AuditLog) (*Membership, error) {
+	nodes := make(map[string]consistent_hash.ServerNode)
+	ringNodes := make(map[string]consistent_hash.ServerNode)
+	for _, node := range nodeList {
+		nodes[node.ID] = node
+		ringNodes[node.ID] = node
+	}
+	ring, err := consistent_hash.New(algorithm, ringNodes)
+	if err != nil {
+		return nil, err
+	}
+	return &Membership{algorithm: algorithm, nodes: nodes, ring: ring, draining: make(map[string]bool),
+		unhealthy: make(map[string]bool), audit: audit, version: 1}, nil
+}
+
+// Nodes returns all known nodes, including draining ones, sorted by ID
+func (m *Membership) Nodes() []consistent_hash.ServerNode {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	nodes := make([]consistent_hash.ServerNode, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// Stats returns the ring version and deletion counts
+func (m *Membership) Stats() MembershipStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return MembershipStats{Version: m.version, Expired: m.expired, Removed: m.removed}
+}
+
+// RingShares returns the fraction of keys each node owns in the ring of its
+// namespace. The ring types do not expose their hash space, so the shares are
+// estimated by looking up a fixed set of sample keys.
+func (m *Membership) RingShares() map[string]float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.shares == nil || m.sharesVersion != m.version {
+		counts := make(map[string]int, len(m.nodes))
+		namespaces := map[string]bool{DefaultNamespace: true}
+		for _, namespace := range m.namespaceOf {
+			namespaces[namespace] = true
+		}
+		for namespace := range namespaces {
+			ring := m.namespaceRing(namespace)
+			if ring.size == 0 {
+				continue
+			}
+			for i := 0; i < ringShareSamples; i++ {
+				counts[ring.ring.ValueLookup(fmt.Sprintf("ring-share-%d", i))]++
+			}
+		}
+		m.shares = make(map[string]float64, len(counts))
+		for id, count := range counts {
+			m.shares[id] = float64(count) / ringShareSamples
+		}
+		m.sharesVersion = m.version
+	}
+	shares := make(map[string]float64, len(m.shares))
+	for id, share := range m.shares {
+		shares[id] = share
+	}
+	return shares
+}
+
+// ringSize returns the number of nodes in the ring, the caller holds the mutex
+func (m *Membership) ringSize() int {
+	return len(m.nodes) - len(m.draining)
+}
+
+// State returns whether the node is active or draining
+func (m *Membership) State(id string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.draining[id] {
+		return NodeDraining
+	}
+	return NodeActive
+}
+
+// SetState takes a node out of the ring when it is set to draining and puts
+// it back when it is set to active. It reports whether the node is known.
+func (m *Membership) SetState(id string, state string, change Change) bool {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	if m.draining[id] == (state == NodeDraining) {
+		return true
+	}
+	old := NodeActive
+	if state == NodeDraining {
+		m.ring.DeleteNode(id)
+		m.draining[id] = true
+	} else {
+		m.ring.InsertNode(id, node.Addr, node.Replicas)
+		delete(m.draining, id)
+		old = NodeDraining
+	}
+	m.version++
+	m.record(AuditSetState, id, change, map[string]any{"old_state": old, "new_state": state})
+	return true
+}
+
+// Node returns the node with the given ID
+func (m *Membership) Node(id string) (consistent_hash.ServerNode, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	node, ok := m.nodes[id]
+	return node, ok
+}
+
+// IDs returns the IDs of all nodes in the ring in sorted order
+func (m *Membership) IDs() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ids := make([]string, 0, len(m.nodes))
+	for id := range m.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// live reports whether a node sent a heartbeat within timeout and is not
+// failing its health probes, the caller holds the mutex
+func (m *Membership) live(node consistent_hash.ServerNode, timeout time.Duration) bool {
+	return time.Since(node.Timestamp) <= timeout && !m.unhealthy[node.ID]
+}
+
+// Live reports whether a node sent a heartbeat within timeout and is not
+// failing its health probes
+func (m *Membership) Live(node consistent_hash.ServerNode, timeout time.Duration) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.live(node, timeout)
+}
+
+// SetHealthy records whether a node passes its health probes
+func (m *Membership) SetHealthy(id string, healthy bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[id]; !exists || healthy {
+		delete(m.unhealthy, id)
+		return
+	}
+	m.unhealthy[id] = true
+}
+
+// LiveNodes returns the live nodes sorted by ID
+func (m *Membership) LiveNodes(timeout time.Duration) []consistent_hash.ServerNode {
+	live := make([]consistent_hash.ServerNode, 0)
+	for _, node := range m.Nodes() {
+		if m.Live(node, timeout) {
+			live = append(live, node)
+		}
+	}
+	return live
+}
+
+// RingNodes returns the ring version with the nodes in the namespace's ring
+// sorted by ID, and which of them are live. A ring built from all of these
+// nodes, skipping the ones that are not live, routes every URL to the same
+// node as Owners. Removing them instead would move other URLs with the simple
+// algorithm, whose owners depend on the number of nodes.
+func (m *Membership) RingNodes(namespace string, timeout time.Duration) (uint64, []consistent_hash.ServerNode, map[string]bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	nodes := make([]consistent_hash.ServerNode, 0, len(m.nodes))
+	live := make(map[string]bool, len(m.nodes))
+	for _, node := range m.nodes {
+		if !m.draining[node.ID] && m.namespace(node.ID) == namespace {
+			nodes = append(nodes, node)
+			live[node.ID] = m.live(node, timeout)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return m.version, nodes, live
+}
+
+// LiveCount returns the number of live nodes
+func (m *Membership) LiveCount(timeout time.Duration) int {
+	return len(m.LiveNodes(timeout))
+}
+
+// Lookup returns the live node owning url in the namespace's ring. Owners
+// that have not sent a heartbeat within timeout are deleted until a live one
+// is found, except on replicated routers, which leave their deletion to the
+// Raft leader. Owners failing their health probes are skipped but kept, so
+// they are used again once they recover.
+func (m *Membership) Lookup(namespace string, url string, timeout time.Duration) (consistent_hash.ServerNode, bool) {
+	m.mutex.RLock()
+	ring := m.namespaceRing(namespace)
+	if ring.size == 0 {
+		m.mutex.RUnlock()
+		return consistent_hash.ServerNode{}, false
+	}
+	node, ok := m.nodes[ring.ring.ValueLookup(url)]
+	live := ok && m.live(node, timeout)
+	m.mutex.RUnlock()
+	if live {
+		return node, true
+	}
+
+	if !m.replicated {
+		m.mutex.Lock()
+		for {
+			ring := m.namespaceRing(namespace)
+			if ring.size == 0 {
+				break
+			}
+			node, ok := m.nodes[ring.ring.ValueLookup(url)]
+			if !ok || time.Since(node.Timestamp) <= timeout {
+				break
+			}
+			m.expire(node, Change{Actor: "router", Reason: "heartbeat timeout"})
+		}
+		m.mutex.Unlock()
+		m.flushAudit()
+	}
+	if owners := m.Owners(namespace, url, 1, timeout); len(owners) > 0 {
+		return owners[0], true
+	}
+	return consistent_hash.ServerNode{}, false
+}
+
+// Expire deletes a node that stopped sending heartbeats and reports whether it
+// was present
+func (m *Membership) Expire(id string, change Change) bool {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	m.expire(node, change)
+	return true
+}
+
+// expire deletes an expired node, the caller holds the mutex
+func (m *Membership) expire(node consistent_hash.ServerNode, change Change) {
+	m.ring.DeleteNode(node.ID)
+	delete(m.nodes, node.ID)
+	delete(m.draining, node.ID)
+	delete(m.unhealthy, node.ID)
+	m.version++
+	m.expired++
+	m.record(AuditExpire, node.ID, change, map[string]any{"addr": node.Addr, "last_heartbeat": node.Timestamp})
+}
+
+// ExpiredNodes returns the IDs of the nodes that have not sent a heartbeat
+// within timeout
+func (m *Membership) ExpiredNodes(timeout time.Duration) []string {
+	expired := make([]string, 0)
+	for _, node := range m.Nodes() {
+		if time.Since(node.Timestamp) > timeout {
+			expired = append(expired, node.ID)
+		}
+	}
+	return expired
+}
+
+// Owners returns up to n live nodes for url in the namespace's ring order.
+// Other nodes are skipped, dead ones are left for Lookup to delete.
+func (m *Membership) Owners(namespace string, url string, n int, timeout time.Duration) []consistent_hash.ServerNode {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	owners := make([]consistent_hash.ServerNode, 0, n)
+	ring := m.namespaceRing(namespace)
+	if ring.size == 0 {
+		return owners
+	}
+	for _, id := range ring.ring.ValueLookupN(url, ring.size) {
+		node, ok := m.nodes[id]
+		if !ok || !m.live(node, timeout) {
+			continue
+		}
+		owners = append(owners, node)
+		if len(owners) == n {
+			break
+		}
+	}
+	return owners
+}
+
+// SetNamespaces assigns nodes to namespaces by ID. Nodes not in namespaceOf,
+// including nodes added later, belong to the default namespace.
+func (m *Membership) SetNamespaces(namespaceOf map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.namespaceOf = namespaceOf
+	m.namespaceRings = nil
+	m.shares = nil
+}
+
+// NamespaceOf returns the namespace a node belongs to
+func (m *Membership) NamespaceOf(id string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.namespace(id)
+}
+
+// namespace returns the namespace of a node, the caller holds the mutex
+func (m *Membership) namespace(id string) string {
+	if namespace, ok := m.namespaceOf[id]; ok {
+		return namespace
+	}
+	return DefaultNamespace
+}
+
+// namespaceRing returns the ring of a namespace, the caller holds the mutex
+// for reading or writing. Without namespaces every node is in the default
+// namespace and the full ring is used. Namespace rings are rebuilt after the
+// ring version changes, rebuilds are serialized by the namespace mutex since
+// readers may get here concurrently.
+func (m *Membership) namespaceRing(namespace string) namespaceRing {
+	if len(m.namespaceOf) == 0 {
+		if namespace != DefaultNamespace {
+			return namespaceRing{}
+		}
+		return namespaceRing{ring: m.ring, size: m.ringSize()}
+	}
+	m.namespaceMutex.Lock()
+	defer m.namespaceMutex.Unlock()
+	if m.namespaceRings == nil || m.namespaceVersion != m.version {
+		members := make(map[string]map[string]consistent_hash.ServerNode)
+		for id, node := range m.nodes {
+			if m.draining[id] {
+				continue
+			}
+			name := m.namespace(id)
+			if members[name] == nil {
+				members[name] = make(map[string]consistent_hash.ServerNode)
+			}
+			members[name][id] = node
+		}
+		m.namespaceRings = make(map[string]namespaceRing, len(members))
+		for name, nodes := range members {
+			// The algorithm was validated when the membership was created
+			ring, _ := consistent_hash.New(m.algorithm, nodes)
+			m.namespaceRings[name] = namespaceRing{ring: ring, size: len(nodes)}
+		}
+		m.namespaceVersion = m.version
+	}
+	return m.namespaceRings[namespace]
+}
+
+// Insert adds a node to the ring, or updates its address and replica count if
+// it is already there. A draining node stays out of the ring.
+func (m *Membership) Insert(id string, addr string, replicas int, change Change) {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	details := map[string]any{"addr": addr, "replicas": replicas}
+	if !exists {
+		// Give new nodes time to start sending heartbeats
+		node = consistent_hash.ServerNode{ID: id, Timestamp: time.Now().Add(60 * time.Second)}
+	} else {
+		details["old_addr"], details["old_replicas"] = node.Addr, node.Replicas
+	}
+	node.Addr = addr
+	node.Replicas = replicas
+	m.nodes[id] = node
+	if !m.draining[id] {
+		m.ring.InsertNode(id, addr, replicas)
+	}
+	m.version++
+	m.record(AuditInsert, id, change, details)
+}
+
+// Delete removes a node from the ring and reports whether it was present
+func (m *Membership) Delete(id string, change Change) bool {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	m.ring.DeleteNode(id)
+	delete(m.nodes, id)
+	delete(m.draining, id)
+	delete(m.unhealthy, id)
+	m.version++
+	m.removed++
+	m.record(AuditDelete, id, change, map[string]any{"addr": node.Addr})
+	return true
+}
+
+// Heartbeat refreshes a node's timestamp and reports whether the node is
+// known. Heartbeats are not authenticated, so they never change the ring.
+func (m *Membership) Heartbeat(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	node.Timestamp = time.Now()
+	m.nodes[id] = node
+	return true
+}
+
+// SetAddr moves a node to a new address and reports whether it is known
+func (m *Membership) SetAddr(id string, addr string, change Change) bool {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	if addr != node.Addr {
+		m.nodes[id] = m.setAddr(node, addr, change)
+	}
+	return true
+}
+
+// setAddr returns node with its new address after re-registering it in the
+// ring, the caller holds the mutex and stores the node
+func (m *Membership) setAddr(node consistent_hash.ServerNode, addr string, change Change) consistent_hash.ServerNode {
+	old := node.Addr
+	node.Addr = addr
+	if !m.draining[node.ID] {
+		m.ring.InsertNode(node.ID, addr, node.Replicas)
+	}
+	m.version++
+	m.record(AuditAddressChange, node.ID, change, map[string]any{"old_addr": old, "new_addr": addr})
+	return node
+}
+
+// SetReplicas changes a node's weight in the ring. Only the node's own virtual
+// nodes are replaced. It reports whether the node is known.
+func (m *Membership) SetReplicas(id string, replicas int, change Change) bool {
+	defer m.flushAudit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return false
+	}
+	if node.Replicas == replicas {
+		return true
+	}
+	old := node.Replicas
+	node.Replicas = replicas
+	m.nodes[id] = node
+	if !m.draining[id] {
+		m.ring.InsertNode(id, node.Addr, replicas)
+	}
+	m.version++
+	m.record(AuditSetWeight, id, change, map[string]any{"old_replicas": old, "new_replicas": replicas})
+	return true
+}
+
+// MembershipSnapshot is the replicated part of the membership: the nodes with
+// their weights and states, the ring version and the deletion counts.
+// Heartbeat timestamps are local to each router and not included.
+type MembershipSnapshot struct {
+	Version  uint64       `json:"version"`
+	Expired  uint64       `json:"expired"`
+	Removed  uint64       `json:"removed"`
+	Nodes    []NodeConfig `json:"nodes"`
+	Draining []string     `json:"draining"`
+}
+
+// Snapshot returns the replicated state of the membership
+func (m *Membership) Snapshot() MembershipSnapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	snapshot := MembershipSnapshot{Version: m.version, Expired: m.expired, Removed: m.removed,
+		Nodes: make([]NodeConfig, 0, len(m.nodes)), Draining: make([]string, 0, len(m.draining))}
+	for _, node := range m.nodes {
+		snapshot.Nodes = append(snapshot.Nodes, NodeConfig{ID: node.ID, Addr: node.Addr, Replicas: node.Replicas})
+	}
+	for id := range m.draining {
+		snapshot.Draining = append(snapshot.Draining, id)
+	}
+	return snapshot
+}
+
+// Restore replaces the membership with a snapshot, rebuilding the ring. Known
+// nodes keep their heartbeat timestamps and new ones get time to send one.
+func (m *Membership) Restore(snapshot MembershipSnapshot) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	nodes := make(map[string]consistent_hash.ServerNode, len(snapshot.Nodes))
+	draining := make(map[string]bool, len(snapshot.Draining))
+	for _, id := range snapshot.Draining {
+		draining[id] = true
+	}
+	ringNodes := make(map[string]consistent_hash.ServerNode, len(snapshot.Nodes))
+	for _, config := range snapshot.Nodes {
+		node := consistent_hash.ServerNode{ID: config.ID, Addr: config.Addr, Replicas: config.Replicas,
+			Timestamp: time.Now().Add(60 * time.Second)}
+		if existing, ok := m.nodes[config.ID]; ok {
+			node.Timestamp = existing.Timestamp
+		}
+		nodes[node.ID] = node
+		if !draining[node.ID] {
+			ringNodes[node.ID] = node
+		}
+	}
+	ring, err := consistent_hash.New(m.algorithm, ringNodes)
+	if err != nil {
+		return err
+	}
+	for id := range m.unhealthy {
+		if _, ok := nodes[id]; !ok {
+			delete(m.unhealthy, id)
+		}
+	}
+	m.nodes, m.ring, m.draining = nodes, ring, draining
+	m.version, m.expired, m.removed = snapshot.Version, snapshot.Expired, snapshot.Removed
+	m.namespaceRings = nil
+	// The restored version may match the one the shares were cached at
+	m.shares = nil
+	return nil
+}
+
+// record queues the audit record of a change that moved the ring to the
+// current version, the caller holds the mutex and calls flushAudit after
+// releasing it
+func (m *Membership) record(action string, id string, change Change, details map[string]any) {
+	if change.Index != 0 {
+		details["raft_index"] = change.Index
+	}
+	m.pending = append(m.pending, AuditRecord{
+		Action:     action,
+		Node:       id,
+		Actor:      change.Actor,
+		Reason:     change.Reason,
+		OldVersion: m.version - 1,
+		NewVersion: m.version,
+		Details:    details,
+	})
+}
+
+// flushAudit writes the queued audit records, the caller must not hold the
+// mutex
+func (m *Membership) flushAudit() {
+	m.auditMutex.Lock()
+	defer m.auditMutex.Unlock()
+	m.mutex.Lock()
+	pending := m.pending
+	m.pending = nil
+	m.mutex.Unlock()
+	for _, record := range pending {
+		m.audit.Record(record)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the routing latency
+// histogram. Routing only hashes the URL, so most lookups take microseconds.
+var latencyBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.1}
+
+// Metrics counts what the router does for the /metrics endpoint
+type Metrics struct {
+	// requests and dispersed count routed requests per destination node ID,
+	// dispersed only those sent to one of a hot URL's extra owners
+	requests  map[string]uint64
+	dispersed map[string]uint64
+	// unroutable counts requests rejected because no live node was found
+	unroutable uint64
+	// namespaceRequests and throttled count requests per namespace, throttled
+	// only those rejected for exceeding the namespace's quota
+	namespaceRequests map[string]uint64
+	throttled         map[string]uint64
+	// rateLimited counts requests rejected by the per-client rate limit and
+	// shed those rejected by load shedding, by reason
+	rateLimited uint64
+	shed        map[string]uint64
+	// diverted counts proxied requests sent to a faster replica instead of
+	// the primary owner, per destination node ID
+	diverted map[string]uint64
+	// latencyCounts holds one count per bucket plus one for larger latencies
+	latencyCounts []uint64
+	latencySum    float64
+	mutex         sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:          make(map[string]uint64),
+		dispersed:         make(map[string]uint64),
+		namespaceRequests: make(map[string]uint64),
+		throttled:         make(map[string]uint64),
+		shed:              make(map[string]uint64),
+		diverted:          make(map[string]uint64),
+		latencyCounts:     make([]uint64, len(latencyBuckets)+1),
+	}
+}
+
+// RecordRouted counts a request sent to node after routing took latency
+func (m *Metrics) RecordRouted(node string, dispersed bool, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[node]++
+	if dispersed {
+		m.dispersed[node]++
+	}
+	seconds := latency.Seconds()
+	m.latencyCounts[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	m.latencySum += seconds
+}
+
+// Routed returns the number of requests routed to each node so far
+func (m *Metrics) Routed() map[string]uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	routed := make(map[string]uint64, len(m.requests))
+	for id, count := range m.requests {
+		routed[id] = count
+	}
+	return routed
+}
+
+// RecordUnroutable counts a request no live node could serve
+func (m *Metrics) RecordUnroutable() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.unroutable++
+}
+
+// RecordNamespace counts a request for a namespace and whether it was
+// rejected by the namespace's quota
+func (m *Metrics) RecordNamespace(namespace string, throttled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.namespaceRequests[namespace]++
+	if throttled {
+		m.throttled[namespace]++
+	}
+}
+
+// Namespaces returns the requests and throttled requests of each namespace
+// so far
+func (m *Metrics) Namespaces() (map[string]uint64, map[string]uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	requests := make(map[string]uint64, len(m.namespaceRequests))
+	for name, count := range m.namespaceRequests {
+		requests[name] = count
+	}
+	throttled := make(map[string]uint64, len(m.throttled))
+	for name, count := range m.throttled {
+		throttled[name] = count
+	}
+	return requests, throttled
+}
+
+// RecordRateLimited counts a request rejected by the per-client rate limit
+func (m *Metrics) RecordRateLimited() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rateLimited++
+}
+
+// RecordShed counts a request shed for reason
+func (m *Metrics) RecordShed(reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.shed[reason]++
+}
+
+// RecordDiverted counts a proxied request sent to node because it responds
+// faster than the primary owner
+func (m *Metrics) RecordDiverted(node string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.diverted[node]++
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw metricsWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(mw.w, "%s%s %v\n", name, labels, value)
+}
+
+// label formats a label pair, escaping the value as the format requires
+func label(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+// writeCounters writes one sample per node or namespace in sorted order, with
+// its ID as the value of labelName
+func (mw metricsWriter) writeCounters(name string, labelName string, counts map[string]uint64) {
+	ids := make([]string, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		mw.sample(name, label(labelName, id), float64(counts[id]))
+	}
+}
+
+// processMetrics reports the router's request counts, routing latencies and
+// ring state in the Prometheus text format
+func (main Main) processMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	metrics := main.metrics
+	metrics.mutex.Lock()
+	mw.header("router_requests_total", "counter", "Requests routed to each cache node.")
+	mw.writeCounters("router_requests_total", "node", metrics.requests)
+	mw.header("router_hot_key_dispersed_requests_total", "counter", "Requests for hot URLs routed to each cache node.")
+	mw.writeCounters("router_hot_key_dispersed_requests_total", "node", metrics.dispersed)
+	mw.header("router_unroutable_requests_total", "counter", "Requests rejected because no live node was available.")
+	mw.sample("router_unroutable_requests_total", "", float64(metrics.unroutable))
+	mw.header("router_namespace_requests_total", "counter", "Requests received for each namespace.")
+	mw.writeCounters("router_namespace_requests_total", "namespace", metrics.namespaceRequests)
+	mw.header("router_namespace_throttled_requests_total", "counter", "Requests rejected for exceeding the quota of each namespace.")
+	mw.writeCounters("router_namespace_throttled_requests_total", "namespace", metrics.throttled)
+	mw.header("router_rate_limited_requests_total", "counter", "Requests rejected by the per-client rate limit.")
+	mw.sample("router_rate_limited_requests_total", "", float64(metrics.rateLimited))
+	mw.header("router_shed_requests_total", "counter", "Requests shed because the cluster or the router was overloaded, by reason.")
+	mw.sample("router_shed_requests_total", label("reason", ShedLoad), float64(metrics.shed[ShedLoad]))
+	mw.sample("router_shed_requests_total", label("reason", ShedInFlight), float64(metrics.shed[ShedInFlight]))
+	mw.header("router_latency_diverted_requests_total", "counter", "Proxied requests routed to each cache node because it responded faster than the primary owner.")
+	mw.writeCounters("router_latency_diverted_requests_total", "node", metrics.diverted)
+
+	mw.header("router_routing_latency_seconds", "histogram", "Time taken to choose the cache node for a request.")
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += metrics.latencyCounts[i]
+		mw.sample("router_routing_latency_seconds_bucket", label("le", fmt.Sprint(bound)), float64(cumulative))
+	}
+	cumulative += metrics.latencyCounts[len(latencyBuckets)]
+	mw.sample("router_routing_latency_seconds_bucket", label("le", "+Inf"), float64(cumulative))
+	mw.sample("router_routing_latency_seconds_sum", "", metrics.latencySum)
+	mw.sample("router_routing_latency_seconds_count", "", float64(cumulative))
+	metrics.mutex.Unlock()
+
+	config := main.config.Load()
+	nodes := main.membership.Nodes()
+	stats := main.membership.Stats()
+	mw.header("router_ring_nodes", "gauge", "Cache nodes in the ring.")
+	mw.sample("router_ring_nodes", "", float64(len(nodes)))
+	mw.header("router_ring_live_nodes", "gauge", "Cache nodes that sent a heartbeat within the timeout and pass their health probes.")
+	mw.sample("router_ring_live_nodes", "", float64(main.membership.LiveCount(config.HeartbeatTimeout)))
+	mw.header("router_ring_version", "gauge", "Number of changes made to the ring since the router started.")
+	mw.sample("router_ring_version", "", float64(stats.Version))
+
+	mw.header("router_node_replicas", "gauge", "Virtual nodes of each cache node in the ring.")
+	for _, node := range nodes {
+		mw.sample("router_node_replicas", label("node", node.ID), float64(node.Replicas))
+	}
+	mw.header("router_node_heartbeat_age_seconds", "gauge", "Time since each cache node last sent a heartbeat.")
+	for _, node := range nodes {
+		// Nodes that were just added have a grace period and a timestamp in the future
+		mw.sample("router_node_heartbeat_age_seconds", label("node", node.ID), max(time.Since(node.Timestamp).Seconds(), 0))
+	}
+
+	health := main.health.All()
+	mw.header("router_node_healthy", "gauge", "Whether each probed cache node passes its health probes.")
+	for _, node := range nodes {
+		if h, ok := health[node.ID]; ok {
+			healthy := 0.0
+			if h.Healthy {
+				healthy = 1
+			}
+			mw.sample("router_node_healthy", label("node", node.ID), healthy)
+		}
+	}
+	mw.header("router_node_health_probe_failures_total", "counter", "Failed health probes of each cache node.")
+	for _, node := range nodes {
+		if h, ok := health[node.ID]; ok {
+			mw.sample("router_node_health_probe_failures_total", label("node", node.ID), float64(h.Failures))
+		}
+	}
+
+	responseTimes := main.responseTimes.All()
+	mw.header("router_node_response_seconds_ewma", "gauge", "Average response time of each cache node to proxied requests.")
+	for _, node := range nodes {
+		if t, ok := responseTimes[node.ID]; ok {
+			mw.sample("router_node_response_seconds_ewma", label("node", node.ID), t.EWMA.Seconds())
+		}
+	}
+
+	mw.header("router_node_deletions_total", "counter", "Cache nodes deleted from the ring by reason.")
+	mw.sample("router_node_deletions_total", label("reason", "heartbeat_timeout"), float64(stats.Expired))
+	mw.sample("router_node_deletions_total", label("reason", "admin"), float64(stats.Removed))
+
+	mw.header("router_hot_key_threshold", "gauge", "Active hot key threshold in requests per second.")
+	mw.sample("router_hot_key_threshold", "", main.capacity.Threshold())
+	mw.header("router_node_capacity", "gauge", "Estimated requests per second one cache node serves.")
+	mw.sample("router_node_capacity", "", main.capacity.NodeCapacity())
+
+	mw.header("router_in_flight_requests", "gauge", "Requests the router is handling.")
+	mw.sample("router_in_flight_requests", "", float64(main.shedder.InFlight()))
+	mw.header("router_estimated_load", "gauge", "Estimated requests per second sent to the cluster, used for load shedding.")
+	mw.sample("router_estimated_load", "", main.shedder.Load(time.Now(), config))
+	mw.header("router_cluster_capacity", "gauge", "Requests per second the live nodes can serve before load is shed, 0 when shedding by load is off.")
+	mw.sample("router_cluster_capacity", "", main.shedder.Capacity())
+	mw.header("router_rate_limited_clients", "gauge", "Clients with a rate limit bucket.")
+	mw.sample("router_rate_limited_clients", "", float64(main.rateLimiter.Size()))
+}
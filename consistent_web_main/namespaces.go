@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace holds the nodes no namespace lists and serves the requests
+// that select no namespace
+const DefaultNamespace = "default"
+
+// Namespaces keeps the request state of every namespace: its hot key counts
+// and its quota. Rings are kept by the membership.
+type Namespaces struct {
+	hotKeys map[string]*HotKeys
+	quotas  map[string]*TokenBucket
+	mutex   sync.Mutex
+}
+
+// NewNamespaces creates the namespace state, with defaultHotKeys counting the
+// requests of the default namespace
+func NewNamespaces(defaultHotKeys *HotKeys) *Namespaces {
+	return &Namespaces{
+		hotKeys: map[string]*HotKeys{DefaultNamespace: defaultHotKeys},
+		quotas:  make(map[string]*TokenBucket),
+	}
+}
+
+// HotKeys returns the hot key counts of a namespace, creating them with the
+// tracker sizes in config when the namespace is first used
+func (n *Namespaces) HotKeys(name string, config *Config) *HotKeys {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	hotKeys, ok := n.hotKeys[name]
+	if !ok {
+		hotKeys = Keys(config.HotKeyCapacity, config.HotKeySketchWidth, config.HotKeySketchDepth)
+		n.hotKeys[name] = hotKeys
+	}
+	return hotKeys
+}
+
+// Allow takes a request from the namespace's quota and reports whether it was
+// within it. Namespaces without a quota rate are never limited.
+func (n *Namespaces) Allow(namespace NamespaceConfig, now time.Time) bool {
+	if namespace.QuotaRate <= 0 {
+		return true
+	}
+	n.mutex.Lock()
+	bucket, ok := n.quotas[namespace.Name]
+	if !ok {
+		bucket = &TokenBucket{}
+		n.quotas[namespace.Name] = bucket
+	}
+	n.mutex.Unlock()
+	burst := namespace.QuotaBurst
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(namespace.QuotaRate)))
+	}
+	return bucket.Allow(now, namespace.QuotaRate, burst)
+}
+
+// selectNamespace returns the namespace a request is for: the one named by
+// the namespace header, else the one with the request's host name, else the
+// one whose path prefix the request path starts with, else the default one.
+// Forward proxy requests carry the origin's host and path, so they can only
+// select a namespace by header.
+func selectNamespace(r *http.Request, config *Config) (NamespaceConfig, error) {
+	if config.NamespaceHeader != "" {
+		if name := r.Header.Get(config.NamespaceHeader); name != "" {
+			namespace, ok := config.Namespace(name)
+			if !ok {
+				return NamespaceConfig{}, fmt.Errorf("unknown namespace %q", name)
+			}
+			return namespace, nil
+		}
+	}
+	if r.URL.IsAbs() {
+		return NamespaceConfig{Name: DefaultNamespace}, nil
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, namespace := range config.Namespaces {
+		for _, name := range namespace.Hosts {
+			if strings.EqualFold(host, name) {
+				return namespace, nil
+			}
+		}
+	}
+	for _, namespace := range config.Namespaces {
+		prefix := strings.TrimSuffix(namespace.PathPrefix, "/")
+		if prefix != "" && (r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")) {
+			return namespace, nil
+		}
+	}
+	return NamespaceConfig{Name: DefaultNamespace}, nil
+}
+
+// namespaceView is a namespace as reported by the admin API
+type namespaceView struct {
+	Name              string   `json:"name"`
+	Hosts             []string `json:"hosts,omitempty"`
+	PathPrefix        string   `json:"path_prefix,omitempty"`
+	Nodes             []string `json:"nodes"`
+	LiveNodes         int      `json:"live_nodes"`
+	HotKeyThreshold   float64  `json:"hot_key_threshold"`
+	HotKeyMaxReplicas int      `json:"hot_key_max_replicas"`
+	QuotaRate         float64  `json:"quota_rate,omitempty"`
+	QuotaBurst        int      `json:"quota_burst,omitempty"`
+	Requests          uint64   `json:"requests"`
+	Throttled         uint64   `json:"throttled"`
+}
+
+// processNamespaces lists the namespaces with their nodes, effective hot key
+// settings, quotas and request counts
+func (main Main) processNamespaces(w http.ResponseWriter, r *http.Request) {
+	config := main.config.Load()
+	requests, throttled := main.metrics.Namespaces()
+	namespaces := append([]NamespaceConfig{{Name: DefaultNamespace}}, config.Namespaces...)
+	views := make([]namespaceView, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		threshold, maxReplicas := main.hotKeySettings(namespace, config)
+		view := namespaceView{
+			Name:              namespace.Name,
+			Hosts:             namespace.Hosts,
+			PathPrefix:        namespace.PathPrefix,
+			Nodes:             make([]string, 0),
+			HotKeyThreshold:   threshold,
+			HotKeyMaxReplicas: maxReplicas,
+			QuotaRate:         namespace.QuotaRate,
+			QuotaBurst:        namespace.QuotaBurst,
+			Requests:          requests[namespace.Name],
+			Throttled:         throttled[namespace.Name],
+		}
+		for _, node := range main.membership.Nodes() {
+			if main.membership.NamespaceOf(node.ID) != namespace.Name {
+				continue
+			}
+			view.Nodes = append(view.Nodes, node.ID)
+			if main.membership.Live(node, config.HeartbeatTimeout) {
+				view.LiveNodes++
+			}
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views[1:], func(i, j int) bool {
+		return views[i+1].Name < views[j+1].Name
+	})
+	writeJSON(w, map[string]any{"header": config.NamespaceHeader, "namespaces": views})
+}
+
+// hotKeySettings returns the hot key threshold and replica limit used for a
+// namespace, its own or else the router's
+func (main Main) hotKeySettings(namespace NamespaceConfig, config *Config) (float64, int) {
+	threshold, maxReplicas := main.capacity.Threshold(), config.HotKeyMaxReplicas
+	if namespace.HotKeyThreshold > 0 {
+		threshold = namespace.HotKeyThreshold
+	}
+	if namespace.HotKeyMaxReplicas > 0 {
+		maxReplicas = namespace.HotKeyMaxReplicas
+	}
+	return threshold, maxReplicas
+}
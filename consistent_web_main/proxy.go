@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// proxyRequests serves the requests of clients using the router as a standard
+// HTTP forward proxy, such as tools with HTTP_PROXY set, and passes every other
+// request to next. A proxy request names the whole URL in its request line,
+// which becomes the routing and cache key instead of the url query parameter.
+// It is recognised before the mux so an origin path like /metrics is never
+// mistaken for one of the router's endpoints.
+func (main Main) proxyRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			// A tunnel would carry encrypted traffic the caches cannot store
+			http.Error(w, "CONNECT is not supported, request http:// URLs through the proxy", http.StatusMethodNotAllowed)
+			return
+		}
+		if !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET and HEAD requests can be cached", http.StatusMethodNotAllowed)
+			return
+		}
+		main.processURL(w, r, r.URL.String(), true)
+	})
+}
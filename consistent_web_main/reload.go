@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloadConfig reads the config file and flags the router was started with
+// again and applies the settings that can change while serving: the hot key
+// threshold, half-life and replica limit, the heartbeat timeout, node weights,
+// the namespaces and the log level. The port, ring algorithm, proxy timeout,
+// hot key tracker sizes, audit log file and TLS listener only change on
+// restart, as do the Raft and gossip settings, and keep their current values
+// with a warning. Replicated routers only change weights on the leader. actor
+// is recorded in the audit log.
+func (main Main) reloadConfig(actor string) error {
+	main.reloadMutex.Lock()
+	defer main.reloadMutex.Unlock()
+
+	config, err := LoadConfig(main.configArgs)
+	if err != nil {
+		return err
+	}
+	current := main.config.Load()
+
+	if config.Port != current.Port || config.RingAlgorithm != current.RingAlgorithm {
+		main.logger.Warn("Port and ring algorithm changes require a restart, keeping current values",
+			zap.Int("port", current.Port), zap.String("ring_algorithm", current.RingAlgorithm))
+		config.Port = current.Port
+		config.RingAlgorithm = current.RingAlgorithm
+	}
+	if config.ProxyTimeout != current.ProxyTimeout {
+		main.logger.Warn("Proxy timeout changes require a restart, keeping current value", zap.Duration("proxy_timeout", current.ProxyTimeout))
+		config.ProxyTimeout = current.ProxyTimeout
+	}
+	if config.HotKeyCapacity != current.HotKeyCapacity || config.HotKeySketchWidth != current.HotKeySketchWidth ||
+		config.HotKeySketchDepth != current.HotKeySketchDepth {
+		main.logger.Warn("Hot key tracker size changes require a restart, keeping current values",
+			zap.Int("hot_key_capacity", current.HotKeyCapacity), zap.Int("hot_key_sketch_width", current.HotKeySketchWidth),
+			zap.Int("hot_key_sketch_depth", current.HotKeySketchDepth))
+		config.HotKeyCapacity, config.HotKeySketchWidth, config.HotKeySketchDepth = current.HotKeyCapacity, current.HotKeySketchWidth, current.HotKeySketchDepth
+	}
+	if config.AuditLogFile != current.AuditLogFile {
+		main.logger.Warn("Audit log file changes require a restart, keeping current value", zap.String("audit_log_file", current.AuditLogFile))
+		config.AuditLogFile = current.AuditLogFile
+	}
+	if config.TLSPort != current.TLSPort || config.TLSCertFile != current.TLSCertFile || config.TLSKeyFile != current.TLSKeyFile ||
+		config.ClientCAFile != current.ClientCAFile {
+		main.logger.Warn("TLS setting changes require a restart, keeping current values", zap.Int("tls_port", current.TLSPort))
+		config.TLSPort, config.TLSCertFile, config.TLSKeyFile, config.ClientCAFile = current.TLSPort, current.TLSCertFile, current.TLSKeyFile, current.ClientCAFile
+	}
+	if config.RaftID != current.RaftID || config.RaftDir != current.RaftDir || !reflect.DeepEqual(config.RaftPeers, current.RaftPeers) {
+		main.logger.Warn("Raft setting changes require a restart, keeping current values", zap.String("raft_id", current.RaftID))
+		config.RaftID, config.RaftDir, config.RaftPeers = current.RaftID, current.RaftDir, current.RaftPeers
+	}
+	if config.GossipBind != current.GossipBind || config.GossipName != current.GossipName || !reflect.DeepEqual(config.GossipJoin, current.GossipJoin) ||
+		config.GossipKey != current.GossipKey {
+		main.logger.Warn("Gossip setting changes require a restart, keeping current values", zap.String("gossip_bind", current.GossipBind))
+		config.GossipBind, config.GossipName, config.GossipJoin, config.GossipKey = current.GossipBind, current.GossipName, current.GossipJoin, current.GossipKey
+	}
+
+	// Only nodes whose weight changed have their virtual nodes replaced. Nodes
+	// missing from the ring are left alone since membership is managed through
+	// heartbeats and the admin commands.
+	for _, node := range config.Nodes {
+		current, ok := main.membership.Node(node.ID)
+		if !ok || current.Replicas == node.Replicas {
+			continue
+		}
+		cmd := membershipCommand{Op: opWeight, ID: node.ID, Replicas: node.Replicas, Actor: actor, Reason: "config reload"}
+		if _, err := main.applyChange(cmd); err != nil {
+			main.logger.Warn("Node weight left to the Raft leader", zap.String("node", node.ID), zap.Error(err))
+			continue
+		}
+		main.logger.Info("Changed node weight", zap.String("node", node.ID),
+			zap.Int("old_replicas", current.Replicas), zap.Int("new_replicas", node.Replicas))
+	}
+
+	level, err := zapcore.ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	main.logLevel.SetLevel(level)
+
+	main.config.Store(&config)
+	main.membership.SetNamespaces(config.NamespaceAssignments())
+	version := main.membership.Stats().Version
+	main.audit.Record(AuditRecord{
+		Action:     AuditConfigReload,
+		Actor:      actor,
+		OldVersion: version,
+		NewVersion: version,
+		Details:    map[string]any{"changed": configChanges(current, &config)},
+	})
+	main.logger.Info("Reloaded config",
+		zap.Float64("hot_key_threshold", config.HotKeyThreshold),
+		zap.Duration("hot_key_half_life", config.HotKeyHalfLife),
+		zap.Duration("heartbeat_timeout", config.HeartbeatTimeout),
+		zap.String("log_level", config.LogLevel))
+	return nil
+}
+
+// handleReloadSignals reloads the config every time the router receives SIGHUP
+func (main Main) handleReloadSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := main.reloadConfig("signal:SIGHUP"); err != nil {
+				main.logger.Error("Error reloading config", zap.Error(err))
+			}
+		}
+	}()
+}
+
+func (main Main) processReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !main.authorize(w, r, RoleAdmin) {
+		return
+	}
+
+	if err := main.reloadConfig(main.caller(r)); err != nil {
+		http.Error(w, fmt.Sprintf("Error reloading config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Respond with a success message
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+)
+
+// Operations of the membership commands in the Raft log
+const (
+	opInsert  = "insert"
+	opDelete  = "delete"
+	opExpire  = "expire"
+	opAddress = "address"
+	opWeight  = "weight"
+	opState   = "state"
+)
+
+// raftApplyTimeout bounds how long an admin call waits for its change to commit
+const raftApplyTimeout = 5 * time.Second
+
+// errNotLeader is returned when a change is made on a router that is not the
+// Raft leader
+var errNotLeader = errors.New("not the raft leader")
+
+// membershipCommand is a membership change. Single routers apply it directly,
+// replicated routers append it to the Raft log and every router applies it
+// once it is committed.
+type membershipCommand struct {
+	Op       string `json:"op"`
+	ID       string `json:"id"`
+	Addr     string `json:"addr,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+	State    string `json:"state,omitempty"`
+	Actor    string `json:"actor"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// apply makes the change to the membership and reports whether the node was
+// known. index is the Raft log index of the command, 0 for single routers.
+func (cmd membershipCommand) apply(membership *Membership, index uint64) bool {
+	change := Change{Actor: cmd.Actor, Reason: cmd.Reason, Index: index}
+	switch cmd.Op {
+	case opInsert:
+		membership.Insert(cmd.ID, cmd.Addr, cmd.Replicas, change)
+		return true
+	case opDelete:
+		return membership.Delete(cmd.ID, change)
+	case opExpire:
+		return membership.Expire(cmd.ID, change)
+	case opAddress:
+		return membership.SetAddr(cmd.ID, cmd.Addr, change)
+	case opWeight:
+		return membership.SetReplicas(cmd.ID, cmd.Replicas, change)
+	case opState:
+		return membership.SetState(cmd.ID, cmd.State, change)
+	}
+	return false
+}
+
+// Replication replicates membership changes between routers through Raft.
+// Every router serves lookups from its own copy of the membership, only the
+// leader accepts changes.
+type Replication struct {
+	raft   *raft.Raft
+	config *Config
+}
+
+// NewReplication starts the Raft node of this router, bootstrapping the
+// cluster from the configured peers on first start
+func NewReplication(config *Config, membership *Membership, logger *zap.Logger) (*Replication, error) {
+	self, _ := config.RaftPeer(config.RaftID)
+	dir := config.RaftDir
+	if dir == "" {
+		dir = "raft-" + config.RaftID
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating raft dir: %v", err)
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.RaftID)
+	raftConfig.LogOutput = os.Stderr
+	raftConfig.LogLevel = "INFO"
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft log: %v", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft snapshots: %v", err)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", self.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving raft address: %v", err)
+	}
+	transport, err := raft.NewTCPTransport(self.RaftAddr, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on raft address: %v", err)
+	}
+
+	fsm := &membershipFSM{membership: membership, logger: logger}
+	node, err := raft.NewRaft(raftConfig, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		servers := make([]raft.Server, 0, len(config.RaftPeers))
+		for _, peer := range config.RaftPeers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.RaftAddr)})
+		}
+		if err := node.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			return nil, fmt.Errorf("error bootstrapping raft cluster: %v", err)
+		}
+	}
+	return &Replication{raft: node, config: config}, nil
+}
+
+// IsLeader reports whether this router currently accepts changes
+func (r *Replication) IsLeader() bool {
+	return r.raft.State() == raft.Leader
+}
+
+// Leader returns the configured peer that is the current leader
+func (r *Replication) Leader() (PeerConfig, bool) {
+	_, id := r.raft.LeaderWithID()
+	if id == "" {
+		return PeerConfig{}, false
+	}
+	return r.config.RaftPeer(string(id))
+}
+
+// Apply appends cmd to the Raft log and waits until this router applied it.
+// It reports whether the node was known.
+func (r *Replication) Apply(cmd membershipCommand) (bool, error) {
+	if !r.IsLeader() {
+		return false, errNotLeader
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return false, err
+	}
+	future := r.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return false, errNotLeader
+		}
+		return false, err
+	}
+	known, _ := future.Response().(bool)
+	return known, nil
+}
+
+// membershipFSM applies committed commands to the membership
+type membershipFSM struct {
+	membership *Membership
+	logger     *zap.Logger
+}
+
+func (f *membershipFSM) Apply(log *raft.Log) any {
+	var cmd membershipCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		f.logger.Error("Error decoding raft command", zap.Uint64("index", log.Index), zap.Error(err))
+		return false
+	}
+	return cmd.apply(f.membership, log.Index)
+}
+
+func (f *membershipFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return membershipFSMSnapshot(f.membership.Snapshot()), nil
+}
+
+func (f *membershipFSM) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	var snapshot MembershipSnapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return err
+	}
+	return f.membership.Restore(snapshot)
+}
+
+type membershipFSMSnapshot MembershipSnapshot
+
+func (s membershipFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(MembershipSnapshot(s)); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s membershipFSMSnapshot) Release() {}
+
+// applyChange makes a membership change, through the Raft log when routers
+// are replicated. It reports whether the node was known and returns
+// errNotLeader on followers.
+func (main Main) applyChange(cmd membershipCommand) (bool, error) {
+	if main.replication == nil {
+		return cmd.apply(main.membership, 0), nil
+	}
+	return main.replication.Apply(cmd)
+}
+
+// changeError responds to an admin change that failed to apply. Followers
+// redirect the caller to the leader with a 307 so the method and body are
+// sent again.
+func (main Main) changeError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, errNotLeader) {
+		http.Error(w, fmt.Sprintf("Error applying change: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	leader, ok := main.replication.Leader()
+	if !ok {
+		http.Error(w, "No Raft leader elected", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, strings.TrimSuffix(leader.URL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// expireNodes deletes the nodes that stopped sending heartbeats while this
+// router is the Raft leader. Replicated routers never delete them on lookup.
+func (main Main) expireNodes() {
+	for {
+		time.Sleep(time.Second)
+		if !main.replication.IsLeader() {
+			continue
+		}
+		for _, id := range main.membership.ExpiredNodes(main.config.Load().HeartbeatTimeout) {
+			_, err := main.applyChange(membershipCommand{Op: opExpire, ID: id, Actor: "router", Reason: "heartbeat timeout"})
+			if err != nil {
+				main.logger.Warn("Error expiring node", zap.String("node", id), zap.Error(err))
+				break
+			}
+		}
+	}
+}
+
+// processRaft reports this router's Raft state, the leader and the peers
+func (main Main) processRaft(w http.ResponseWriter, r *http.Request) {
+	if main.replication == nil {
+		writeJSON(w, map[string]any{"enabled": false})
+		return
+	}
+	node := main.replication.raft
+	leader, _ := main.replication.Leader()
+	servers := make([]map[string]any, 0)
+	if future := node.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			servers = append(servers, map[string]any{"id": server.ID, "raft_addr": server.Address, "suffrage": server.Suffrage.String()})
+		}
+	}
+	writeJSON(w, map[string]any{
+		"enabled":       true,
+		"id":            main.config.Load().RaftID,
+		"state":         node.State().String(),
+		"leader":        leader.ID,
+		"leader_url":    leader.URL,
+		"term":          node.Stats()["term"],
+		"commit_index":  node.CommitIndex(),
+		"applied_index": node.AppliedIndex(),
+		"ring_version":  main.membership.Stats().Version,
+		"peers":         servers,
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"testing"
+	"time"
+	"web_main/consistent_hash"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// memorySink is a raft.SnapshotSink keeping the snapshot in memory
+type memorySink struct {
+	bytes.Buffer
+}
+
+func (s *memorySink) ID() string    { return "test" }
+func (s *memorySink) Cancel() error { return nil }
+func (s *memorySink) Close() error  { return nil }
+
+func newTestFSM(t *testing.T, nodes []consistent_hash.ServerNode) *membershipFSM {
+	t.Helper()
+	audit, err := OpenAuditLog("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	membership, err := NewMembership(consistent_hash.AlgorithmCycle, nodes, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	membership.replicated = true
+	return &membershipFSM{membership: membership, logger: zap.NewNop()}
+}
+
+// sortedSnapshot returns the membership's snapshot in a stable order
+func sortedSnapshot(m *Membership) MembershipSnapshot {
+	snapshot := m.Snapshot()
+	sort.Slice(snapshot.Nodes, func(i, j int) bool { return snapshot.Nodes[i].ID < snapshot.Nodes[j].ID })
+	sort.Strings(snapshot.Draining)
+	return snapshot
+}
+
+func TestMembershipFSMRoundTrip(t *testing.T) {
+	leader := newTestFSM(t, nil)
+	commands := []struct {
+		cmd   membershipCommand
+		known bool
+	}{
+		{membershipCommand{Op: opInsert, ID: "a", Addr: "localhost:5051", Replicas: 1}, true},
+		{membershipCommand{Op: opInsert, ID: "b", Addr: "localhost:5052", Replicas: 2}, true},
+		{membershipCommand{Op: opInsert, ID: "c", Addr: "localhost:5053", Replicas: 1}, true},
+		{membershipCommand{Op: opInsert, ID: "d", Addr: "localhost:5054", Replicas: 1}, true},
+		{membershipCommand{Op: opWeight, ID: "a", Replicas: 3}, true},
+		{membershipCommand{Op: opAddress, ID: "b", Addr: "localhost:6052"}, true},
+		{membershipCommand{Op: opState, ID: "c", State: NodeDraining}, true},
+		{membershipCommand{Op: opDelete, ID: "d"}, true},
+		{membershipCommand{Op: opExpire, ID: "missing"}, false},
+	}
+	for i, test := range commands {
+		data, err := json.Marshal(test.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if known := leader.Apply(&raft.Log{Index: uint64(i + 1), Data: data}); known != test.known {
+			t.Errorf("apply %s %s = %v, want %v", test.cmd.Op, test.cmd.ID, known, test.known)
+		}
+	}
+
+	want := MembershipSnapshot{
+		Version: 9,
+		Removed: 1,
+		Nodes: []NodeConfig{
+			{ID: "a", Addr: "localhost:5051", Replicas: 3},
+			{ID: "b", Addr: "localhost:6052", Replicas: 2},
+			{ID: "c", Addr: "localhost:5053", Replicas: 1},
+		},
+		Draining: []string{"c"},
+	}
+	got := sortedSnapshot(leader.membership)
+	if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, want); gotJSON != wantJSON {
+		t.Fatalf("snapshot after apply = %s, want %s", gotJSON, wantJSON)
+	}
+
+	snapshot, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	// The follower starts with other nodes at the same version, so cached
+	// ring shares must not survive the restore
+	follower := newTestFSM(t, []consistent_hash.ServerNode{{ID: "x", Addr: "localhost:7000", Replicas: 1}})
+	follower.membership.version = want.Version
+	follower.membership.RingShares()
+	if err := follower.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if gotJSON, wantJSON := mustJSON(t, sortedSnapshot(follower.membership)), mustJSON(t, want); gotJSON != wantJSON {
+		t.Errorf("snapshot after restore = %s, want %s", gotJSON, wantJSON)
+	}
+	shares := follower.membership.RingShares()
+	if _, ok := shares["x"]; ok || len(shares) != 2 {
+		t.Errorf("ring shares after restore = %v, want shares of a and b", shares)
+	}
+	for _, url := range []string{"http://example.com/1", "http://example.com/2", "http://example.com/3"} {
+		leaderOwner, _ := leader.membership.Lookup(DefaultNamespace, url, time.Hour)
+		followerOwner, _ := follower.membership.Lookup(DefaultNamespace, url, time.Hour)
+		if leaderOwner.ID != followerOwner.ID {
+			t.Errorf("owner of %s = %s after restore, want %s", url, followerOwner.ID, leaderOwner.ID)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"web_main/consistent_hash"
+)
+
+// ResponseTime is a node's exponentially weighted moving average response
+// time, measured by the router to the response headers of proxied requests
+type ResponseTime struct {
+	EWMA    time.Duration `json:"ewma"`
+	Samples uint64        `json:"samples"`
+	Updated time.Time     `json:"updated"`
+}
+
+// ResponseTimes keeps the response time average of every node the router
+// proxies to
+type ResponseTimes struct {
+	nodes map[string]*ResponseTime
+	mutex sync.Mutex
+}
+
+func NewResponseTimes() *ResponseTimes {
+	return &ResponseTimes{nodes: make(map[string]*ResponseTime)}
+}
+
+// Record adds a response time measured at now, weighting it by weight in the
+// average. The first response of a node becomes its average.
+func (t *ResponseTimes) Record(id string, elapsed time.Duration, now time.Time, weight float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	node, ok := t.nodes[id]
+	if !ok {
+		node = &ResponseTime{EWMA: elapsed}
+		t.nodes[id] = node
+	} else {
+		node.EWMA = time.Duration(weight*float64(elapsed) + (1-weight)*float64(node.EWMA))
+	}
+	node.Samples++
+	node.Updated = now
+}
+
+// Get returns the average of a node if it was updated within maxAge of now.
+// An older average no longer describes the node.
+func (t *ResponseTimes) Get(id string, now time.Time, maxAge time.Duration) (ResponseTime, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	node, ok := t.nodes[id]
+	if !ok || now.Sub(node.Updated) > maxAge {
+		return ResponseTime{}, false
+	}
+	return *node, true
+}
+
+// All returns the averages of every node measured so far
+func (t *ResponseTimes) All() map[string]ResponseTime {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	all := make(map[string]ResponseTime, len(t.nodes))
+	for id, node := range t.nodes {
+		all[id] = *node
+	}
+	return all
+}
+
+// pickFastest returns the owner a proxied request is sent to. owners are the
+// live replica set of a URL in ring order, so owners[0] is its primary owner.
+// The primary owner keeps the request, and the cache locality that comes
+// with it, unless another owner's average is faster by more than the slack
+// fraction. Owners without a recent average are not considered, and a
+// primary owner without one keeps the request so it gets measured again.
+func (main Main) pickFastest(owners []consistent_hash.ServerNode, now time.Time, config *Config) (consistent_hash.ServerNode, bool) {
+	primary := owners[0]
+	primaryTime, ok := main.responseTimes.Get(primary.ID, now, config.LatencyMaxAge)
+	if !ok {
+		return primary, false
+	}
+	fastest, fastestTime := primary, primaryTime.EWMA
+	for _, owner := range owners[1:] {
+		if measured, ok := main.responseTimes.Get(owner.ID, now, config.LatencyMaxAge); ok && measured.EWMA < fastestTime {
+			fastest, fastestTime = owner, measured.EWMA
+		}
+	}
+	if float64(primaryTime.EWMA) <= float64(fastestTime)*(1+config.LatencySlack) {
+		return primary, false
+	}
+	return fastest, true
+}
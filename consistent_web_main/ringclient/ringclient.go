@@ -0,0 +1,208 @@
+// Package ringclient routes requests straight to the web_cache node that owns
+// a URL, using the ring published by the router on /ring instead of sending
+// every request through it. Lookups use the same consistent_hash
+// implementations and URL normalization as the router, so both agree on the
+// owner of every URL.
+//
+// Hot URL dispersal is done by the router only. Clients that need it should
+// keep sending hot URLs through the router.
+package ringclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"urlnorm"
+	"web_main/consistent_hash"
+)
+
+// Node is a cache node in the published ring. Nodes that are not live, having
+// missed their heartbeats or failed their health probes, stay in the ring and
+// are skipped by lookups, as the router does.
+type Node struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	Replicas int    `json:"replicas"`
+	Live     bool   `json:"live"`
+}
+
+// Ring is the body of the router's /ring response. It lists the nodes that
+// are in the ring of a namespace, sorted by ID, and the query parameters the
+// router strips from URLs before hashing them.
+type Ring struct {
+	Namespace   string   `json:"namespace,omitempty"`
+	Version     uint64   `json:"version"`
+	Algorithm   string   `json:"algorithm"`
+	Hash        string   `json:"hash"`
+	StripParams []string `json:"strip_params,omitempty"`
+	Nodes       []Node   `json:"nodes"`
+}
+
+// Client keeps a copy of the router's ring
+type Client struct {
+	routerURL string
+	namespace string
+	http      *http.Client
+	ring      Ring
+	hash      consistent_hash.ConsistentHash
+	nodes     map[string]Node
+	mutex     sync.RWMutex
+}
+
+// New creates a client for the router at routerURL, such as
+// http://localhost:8080, and fetches the ring of its default namespace
+func New(ctx context.Context, routerURL string) (*Client, error) {
+	return NewNamespace(ctx, routerURL, "")
+}
+
+// NewNamespace creates a client routing over the ring of one of the router's
+// namespaces and fetches it. An empty namespace is the default one.
+func NewNamespace(ctx context.Context, routerURL string, namespace string) (*Client, error) {
+	c := &Client{routerURL: strings.TrimSuffix(routerURL, "/"), namespace: namespace, http: &http.Client{}}
+	if _, err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fetch gets the current ring from the router
+func (c *Client) Fetch(ctx context.Context) (Ring, error) {
+	var ring Ring
+	ringURL := c.routerURL + "/ring"
+	if c.namespace != "" {
+		ringURL += "?namespace=" + url.QueryEscape(c.namespace)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ringURL, nil)
+	if err != nil {
+		return ring, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ring, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ring, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ring)
+	return ring, err
+}
+
+// Refresh fetches the ring and rebuilds the local copy if it changed. It
+// reports whether it did.
+func (c *Client) Refresh(ctx context.Context) (bool, error) {
+	ring, err := c.Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	if ring.Hash != consistent_hash.HashFunction {
+		return false, fmt.Errorf("router uses hash %q, client supports %q", ring.Hash, consistent_hash.HashFunction)
+	}
+
+	c.mutex.RLock()
+	// Nodes may expire without the router changing the version, so the node
+	// list is compared as well
+	unchanged := c.hash != nil && ring.Version == c.ring.Version && reflect.DeepEqual(ring.Nodes, c.ring.Nodes) &&
+		reflect.DeepEqual(ring.StripParams, c.ring.StripParams)
+	c.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	nodes := make(map[string]Node, len(ring.Nodes))
+	nodeMap := make(map[string]consistent_hash.ServerNode, len(ring.Nodes))
+	for _, node := range ring.Nodes {
+		nodes[node.ID] = node
+		nodeMap[node.ID] = consistent_hash.ServerNode{ID: node.ID, Addr: node.Addr, Replicas: node.Replicas}
+	}
+	hash, err := consistent_hash.New(ring.Algorithm, nodeMap)
+	if err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ring, c.hash, c.nodes = ring, hash, nodes
+	return true, nil
+}
+
+// Watch refreshes the ring every interval until ctx is done, calling onChange
+// with the new ring whenever it changes. onChange may be nil. Failed refreshes
+// keep the previous ring and are retried on the next interval.
+func (c *Client) Watch(ctx context.Context, interval time.Duration, onChange func(Ring)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			changed, err := c.Refresh(ctx)
+			if err == nil && changed && onChange != nil {
+				onChange(c.Ring())
+			}
+		}
+	}
+}
+
+// Ring returns the ring the client currently routes with
+func (c *Client) Ring() Ring {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.ring
+}
+
+// Lookup returns the node that owns target
+func (c *Client) Lookup(target string) (Node, error) {
+	node, _, err := c.lookup(target)
+	return node, err
+}
+
+// lookup returns the node that owns target and the canonical form of target
+func (c *Client) lookup(target string) (Node, string, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if len(c.nodes) == 0 {
+		return Node{}, "", fmt.Errorf("no live nodes available")
+	}
+	canonical, err := urlnorm.New(c.ring.StripParams).Normalize(target)
+	if err != nil {
+		return Node{}, "", fmt.Errorf("invalid URL %q: %v", target, err)
+	}
+	// The owner is the first live node from the URL's place in the ring on
+	for _, id := range c.hash.ValueLookupN(canonical, len(c.nodes)) {
+		if node := c.nodes[id]; node.Live {
+			return node, canonical, nil
+		}
+	}
+	return Node{}, "", fmt.Errorf("no live nodes available")
+}
+
+// NodeURL returns the URL on the owning node that serves target, the same
+// URL the router redirects to
+func (c *Client) NodeURL(target string) (string, error) {
+	node, canonical, err := c.lookup(target)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%v/?url=%v", node.Addr, url.QueryEscape(canonical)), nil
+}
+
+// Get fetches target from the node that owns it
+func (c *Client) Get(ctx context.Context, target string) (*http.Response, error) {
+	nodeURL, err := c.NodeURL(target)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
@@ -1,27 +1,43 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
-func SendHeartbeat(mainAddr string) {
+// SendHeartbeat sends a heartbeat to every main server in mainAddrs. Replicated
+// routers each track liveness on their own, so all of them need heartbeats.
+func SendHeartbeat(mainAddrs []string, id string, addr string) {
 	for {
-		// Construct the URL for the heartbeat endpoint
-		endpoint := fmt.Sprintf("http://%s/heartbeat", mainAddr)
-
-		// Construct the POST data: empty data
-		postData := url.Values{}
-
-		// Send heartbeat POST request to master
-		_, err := http.PostForm(endpoint, postData)
-		if err != nil {
-			log.Println("Error sending heartbeat:", err)
-		} else {
-			log.Println("Sent heartbeat to main")
+		for _, mainAddr := range mainAddrs {
+			// Construct the URL for the heartbeat endpoint
+			endpoint := fmt.Sprintf("http://%s/heartbeat", mainAddr)
+
+			// Construct the POST data: the node identity and advertised address
+			postData := url.Values{}
+			postData.Set("id", id)
+			postData.Set("addr", addr)
+
+			// Send heartbeat POST request to master
+			resp, err := http.PostForm(endpoint, postData)
+			if err != nil {
+				log.Println("Error sending heartbeat:", err)
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				// The router does not know this ID or has it at another address
+				log.Printf("Heartbeat rejected by %s: %s: %s", mainAddr, resp.Status, strings.TrimSpace(string(body)))
+				continue
+			}
+			log.Println("Sent heartbeat to", mainAddr)
 		}
 
 		time.Sleep(5 * time.Second) // Send heartbeat every 5 seconds
@@ -30,9 +46,16 @@ func SendHeartbeat(mainAddr string) {
 
 func main() {
 	// main address
-	// If using Google Cloud, change this variable to be the address of the main server
-	mainAddr := "localhost:8080"
+	// If using Google Cloud, pass the address of the main server with -main
+	mainAddr := flag.String("main", "localhost:8080", "address of the main server, or a comma-separated list of replicated routers")
+	addr := flag.String("addr", "localhost:5050", "host:port the web cache advertises to the main server")
+	id := flag.String("id", "", "node ID registered with the main server (defaults to -addr)")
+	flag.Parse()
+
+	if *id == "" {
+		*id = *addr
+	}
 
 	// Start sending heartbeats
-	SendHeartbeat(mainAddr)
+	SendHeartbeat(strings.Split(*mainAddr, ","), *id, *addr)
 }
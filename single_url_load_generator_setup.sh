@@ -8,7 +8,7 @@ gcloud compute instances create "$instance_name" --machine-type=n1-standard-1 --
 sleep 5
 
 echo "Copying files to instance $instance_name"
-gcloud compute scp --recurse --compress main_startup.sh ./consistent_web_main ./single_url_load_generator $instance_name:/home/$username
+gcloud compute scp --recurse --compress main_startup.sh ./consistent_web_main ./urlnorm ./single_url_load_generator $instance_name:/home/$username
 
 
 echo "Running main_startup.sh on instance $instance_name"
@@ -1,4 +1,9 @@
 #!/bin/bash
+# command line arguments: the main server address, this node's ID and the
+# host:port its web cache advertises
+main_addr=$1
+node_id=$2
+node_addr=$3
 
 # Install Go
 sudo apt install git
@@ -24,4 +29,4 @@ echo "Running Go commands..."
 
 # Run Go commands
 go mod tidy
-go run heartbeat.go
+go run heartbeat.go -main "$main_addr" -id "$node_id" -addr "$node_addr"
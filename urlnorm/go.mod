@@ -0,0 +1,3 @@
+module urlnorm
+
+go 1.22
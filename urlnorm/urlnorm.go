@@ -0,0 +1,123 @@
+// Package urlnorm turns URLs into a canonical form, so that URLs naming the
+// same resource are routed to the same cache node and cached once. It is
+// shared by the router, which hashes the canonical URL, and web_cache, which
+// uses it as its cache key.
+package urlnorm
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// defaultPorts are the ports dropped from hosts of their scheme
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Normalizer normalizes URLs, dropping the query parameters in StripParams
+type Normalizer struct {
+	// StripParams lists query parameters that do not change the resource,
+	// such as tracking parameters. A name ending in * strips every
+	// parameter starting with the rest of the name, so utm_* strips
+	// utm_source and utm_medium.
+	StripParams []string
+}
+
+// New creates a Normalizer stripping the given query parameters
+func New(stripParams []string) Normalizer {
+	return Normalizer{StripParams: stripParams}
+}
+
+// Normalize returns the canonical form of an absolute http or https URL:
+//   - the scheme and host are lower case
+//   - the default port of the scheme is removed
+//   - an empty path becomes /
+//   - the stripped parameters are removed and the others are sorted by name,
+//     keeping the order of repeated parameters. Parameters are kept as sent,
+//     without decoding and encoding them again, since the origin may read
+//     them differently than net/url does.
+//   - the fragment is removed
+//
+// Normalizing a canonical URL returns it unchanged.
+func (n Normalizer) Normalize(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if u.Path == "" {
+		u.Path = "/"
+		u.RawPath = ""
+	}
+
+	u.RawQuery = n.normalizeQuery(u.RawQuery)
+	u.ForceQuery = false
+
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), nil
+}
+
+// normalizeQuery removes the stripped parameters from a raw query and sorts
+// the others by name. Only & separates parameters, empty ones are dropped.
+func (n Normalizer) normalizeQuery(rawQuery string) string {
+	type param struct {
+		name string
+		raw  string
+	}
+	params := make([]param, 0)
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(raw, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if !n.strip(name) {
+			params = append(params, param{name: name, raw: raw})
+		}
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		return params[i].name < params[j].name
+	})
+	sorted := make([]string, len(params))
+	for i, p := range params {
+		sorted[i] = p.raw
+	}
+	return strings.Join(sorted, "&")
+}
+
+// strip reports whether the query parameter name is stripped
+func (n Normalizer) strip(name string) bool {
+	for _, param := range n.StripParams {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package urlnorm
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	n := New([]string{"utm_*", "fbclid"})
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"http://example.com", "http://example.com/"},
+		{"HTTP://Example.COM:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://[::1]:80/", "http://[::1]/"},
+		{"http://[::1]:8080/", "http://[::1]:8080/"},
+		{"http://example.com/Path", "http://example.com/Path"},
+		{"http://example.com/?b=2&a=1", "http://example.com/?a=1&b=2"},
+		{"http://example.com/?a=2&b=1&a=1", "http://example.com/?a=2&a=1&b=1"},
+		{"http://example.com/?utm_source=x&id=3&fbclid=y&utm_medium=z", "http://example.com/?id=3"},
+		{"http://example.com/?utm_source=x", "http://example.com/"},
+		{"http://example.com/?", "http://example.com/"},
+		{"http://example.com/?a=1&&b=2", "http://example.com/?a=1&b=2"},
+		{"http://example.com/?a=1;b=2", "http://example.com/?a=1;b=2"},
+		{"http://example.com/?flag&a=1", "http://example.com/?a=1&flag"},
+		{"http://example.com/?q=a+b&p=%2F", "http://example.com/?p=%2F&q=a+b"},
+		{"http://example.com/?utm%5Fsource=x&a=1", "http://example.com/?a=1"},
+		{"http://example.com/a#section", "http://example.com/a"},
+		{"http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+	}
+	for _, test := range tests {
+		got, err := n.Normalize(test.raw)
+		if err != nil {
+			t.Errorf("Normalize(%q) failed: %v", test.raw, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.raw, got, test.want)
+		}
+		again, err := n.Normalize(got)
+		if err != nil || again != got {
+			t.Errorf("Normalize(%q) = %q, %v, want it unchanged", got, again, err)
+		}
+	}
+}
+
+func TestNormalizeRejects(t *testing.T) {
+	n := New(nil)
+	for _, raw := range []string{"ftp://example.com/", "/relative", "http:///path", "http://exa mple.com/"} {
+		if got, err := n.Normalize(raw); err == nil {
+			t.Errorf("Normalize(%q) = %q, want an error", raw, got)
+		}
+	}
+}
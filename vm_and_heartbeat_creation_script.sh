@@ -2,6 +2,8 @@
 # command line arguments
 num_instances=$1
 username=$2
+# host:port of the main server, e.g. <main external IP>:8080
+main_addr=$3
 
 # Create instances
 echo "Creating $num_instances instances..."
@@ -20,8 +22,11 @@ echo "Copying files to instances and running startup script..."
 for ((i=1; i<=num_instances; i++))
 do
     instance_name=go-vm$i
+    # Each node is registered under its instance name at its external IP
+    external_ip=$(gcloud compute instances describe $instance_name --zone=us-west4-a --format='get(networkInterfaces[0].accessConfigs[0].natIP)')
+    echo "$instance_name advertises $external_ip:5050"
     gcloud compute scp --recurse --compress ./startup_script.sh ./heartbeats $instance_name:/home/$username
-    nohup gcloud compute ssh $instance_name --command "chmod +x ./startup_script.sh && nohup ./startup_script.sh >> test.log" & 
+    nohup gcloud compute ssh $instance_name --command "chmod +x ./startup_script.sh && nohup ./startup_script.sh $main_addr $instance_name $external_ip:5050 >> test.log" & 
 done
 
 echo "Instances created successfully!"
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// GossipMeta is the metadata a cache node advertises in the gossip: its HTTP
+// address and weight, which routers and clients observing the gossip use to
+// build the ring. It must match the Meta type of the web_main gossip package.
+type GossipMeta struct {
+	Role     string `json:"role"`
+	Addr     string `json:"addr,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+	Leaving  bool   `json:"leaving,omitempty"`
+}
+
+// Gossip is this node's membership in the gossip
+type Gossip struct {
+	list     *memberlist.Memberlist
+	delegate *gossipDelegate
+}
+
+// gossipRoleCache marks cache nodes, other members are observers
+const gossipRoleCache = "cache"
+
+// gossipRejoinInterval is how often a node that could not reach its seeds
+// tries again
+const gossipRejoinInterval = 5 * time.Second
+
+// parseGossipKey decodes a base64 gossip encryption key of 16, 24 or 32
+// bytes. It must match the key of the routers and every other node.
+func parseGossipKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("gossip key must be base64: %v", err)
+	}
+	if len(decoded) != 16 && len(decoded) != 24 && len(decoded) != 32 {
+		return nil, fmt.Errorf("gossip key must be 16, 24 or 32 bytes, got %d", len(decoded))
+	}
+	return decoded, nil
+}
+
+// StartGossip joins the SWIM gossip among cache nodes under the node's ID,
+// listening on bind (host:port). seeds are host:port gossip addresses of
+// members already running, none starts a new cluster. If no seed answers the
+// node keeps trying to join in the background. Gossip messages are encrypted
+// and authenticated with key.
+func StartGossip(id string, bind string, seeds []string, key []byte, meta GossipMeta, logger *log.Logger) (*Gossip, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+	config := memberlist.DefaultLANConfig()
+	config.Name = id
+	config.BindAddr = host
+	config.BindPort, err = strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing gossip port: %v", err)
+	}
+	config.AdvertisePort = config.BindPort
+	config.SecretKey = key
+	config.Logger = logger
+	delegate := &gossipDelegate{meta: meta}
+	config.Delegate = delegate
+
+	list, err := memberlist.Create(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(seeds) > 0 {
+		if _, err := list.Join(seeds); err != nil {
+			logger.Printf("[WARN] Error joining gossip, retrying: %v", err)
+			go rejoin(list, seeds)
+		}
+	}
+	return &Gossip{list: list, delegate: delegate}, nil
+}
+
+// rejoin retries joining the seeds until one of them answers
+func rejoin(list *memberlist.Memberlist, seeds []string) {
+	for {
+		time.Sleep(gossipRejoinInterval)
+		if _, err := list.Join(seeds); err == nil {
+			return
+		}
+	}
+}
+
+// Leave announces that the node is leaving, so observers take it out of the
+// ring at once instead of waiting for it to fail its probes, then leaves
+func (g *Gossip) Leave(timeout time.Duration) error {
+	g.delegate.setLeaving()
+	if err := g.list.UpdateNode(timeout); err != nil {
+		return err
+	}
+	if err := g.list.Leave(timeout); err != nil {
+		return err
+	}
+	return g.list.Shutdown()
+}
+
+// gossipDelegate advertises the node's metadata. The cluster carries no other
+// state, so the rest of the delegate is empty.
+type gossipDelegate struct {
+	meta  GossipMeta
+	mutex sync.Mutex
+}
+
+func (d *gossipDelegate) setLeaving() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.meta.Leaving = true
+}
+
+func (d *gossipDelegate) NodeMeta(limit int) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	data, _ := json.Marshal(d.meta)
+	return data
+}
+
+func (d *gossipDelegate) NotifyMsg([]byte)                           {}
+func (d *gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *gossipDelegate) LocalState(join bool) []byte                { return nil }
+func (d *gossipDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+type gossipMember struct {
+	ID         string     `json:"id"`
+	GossipAddr string     `json:"gossip_addr"`
+	Meta       GossipMeta `json:"meta"`
+}
+
+// serveMembers lists the gossip members this node considers alive or
+// suspected of failing
+func (g *Gossip) serveMembers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		members := make([]gossipMember, 0)
+		for _, node := range g.list.Members() {
+			member := gossipMember{ID: node.Name, GossipAddr: node.Address()}
+			json.Unmarshal(node.Meta, &member.Meta)
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].ID < members[j].ID
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"members": members})
+	}
+}
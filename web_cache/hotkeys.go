@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HotKeyRate is a URL with its request rate per second
+type HotKeyRate struct {
+	URL  string  `json:"url"`
+	Rate float64 `json:"rate"`
+}
+
+// decayedCount is a URL's decayed request count as of updated. err is the
+// part of the count inherited from the URL it replaced, which decays with it.
+type decayedCount struct {
+	url     string
+	count   float64
+	err     float64
+	updated time.Time
+	index   int
+}
+
+// decay returns the factor counts as of the entry's update shrink by until now
+func (d *decayedCount) decay(now time.Time, lambda float64) float64 {
+	if !now.After(d.updated) {
+		return 1
+	}
+	return math.Exp(-lambda * now.Sub(d.updated).Seconds())
+}
+
+// advance decays the entry to now, requests recorded out of order are counted
+// at the entry's time
+func (d *decayedCount) advance(now time.Time, lambda float64) {
+	factor := d.decay(now, lambda)
+	d.count *= factor
+	d.err *= factor
+	if now.After(d.updated) {
+		d.updated = now
+	}
+}
+
+// HotKeyCounter keeps exponentially decayed request counts for the most
+// requested URLs in fixed memory using the Space-Saving algorithm: when the
+// table is full a new URL replaces the one with the smallest count and
+// inherits it as its error, so hot URLs are never missed and count minus
+// error never overestimates. Entries are kept in a min-heap so the smallest
+// one is found without scanning the table.
+type HotKeyCounter struct {
+	counts   map[string]*decayedCount
+	heap     countHeap
+	capacity int
+	lambda   float64
+	mutex    sync.Mutex
+}
+
+// NewHotKeyCounter creates a counter for capacity URLs whose counts halve every halfLife
+func NewHotKeyCounter(capacity int, halfLife time.Duration) *HotKeyCounter {
+	lambda := math.Ln2 / halfLife.Seconds()
+	return &HotKeyCounter{
+		counts:   make(map[string]*decayedCount, capacity),
+		heap:     countHeap{entries: make([]*decayedCount, 0, capacity), lambda: lambda},
+		capacity: capacity,
+		lambda:   lambda,
+	}
+}
+
+// Record counts a request for url at now
+func (h *HotKeyCounter) Record(url string, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if entry, ok := h.counts[url]; ok {
+		entry.advance(now, h.lambda)
+		entry.count++
+		heap.Fix(&h.heap, entry.index)
+		return
+	}
+
+	if len(h.counts) < h.capacity {
+		entry := &decayedCount{url: url, count: 1, updated: now}
+		h.counts[url] = entry
+		heap.Push(&h.heap, entry)
+		return
+	}
+	if h.capacity <= 0 {
+		return
+	}
+
+	// Replace the URL with the smallest count, which it inherits as its error
+	entry := h.heap.entries[0]
+	delete(h.counts, entry.url)
+	entry.advance(now, h.lambda)
+	entry.url = url
+	entry.err = entry.count
+	entry.count++
+	h.counts[url] = entry
+	heap.Fix(&h.heap, 0)
+}
+
+// Top returns the n URLs with the highest request rates as of now, hottest
+// first. Rates leave out the error inherited on replacement.
+func (h *HotKeyCounter) Top(n int, now time.Time) []HotKeyRate {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	rates := make([]HotKeyRate, 0, len(h.counts))
+	for url, entry := range h.counts {
+		// A steady r requests per second keeps the decayed count at r/lambda
+		count := (entry.count - entry.err) * entry.decay(now, h.lambda)
+		rates = append(rates, HotKeyRate{URL: url, Rate: count * h.lambda})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Rate > rates[j].Rate
+	})
+	if len(rates) > n {
+		rates = rates[:n]
+	}
+	return rates
+}
+
+// countHeap orders entries by decayed count. All counts decay at the same
+// rate, so ln(count) + lambda*t orders them as of any time.
+type countHeap struct {
+	entries []*decayedCount
+	lambda  float64
+}
+
+func (h *countHeap) score(i int) float64 {
+	entry := h.entries[i]
+	return math.Log(entry.count) + h.lambda*float64(entry.updated.UnixNano())/float64(time.Second)
+}
+
+func (h *countHeap) Len() int           { return len(h.entries) }
+func (h *countHeap) Less(i, j int) bool { return h.score(i) < h.score(j) }
+func (h *countHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *countHeap) Push(x any) {
+	entry := x.(*decayedCount)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *countHeap) Pop() any {
+	entry := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return entry
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHotKeyCounterTop(t *testing.T) {
+	halfLife := time.Hour
+	lambda := math.Ln2 / halfLife.Seconds()
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name     string
+		capacity int
+		requests []string
+		at       time.Duration
+		want     map[string]float64
+	}{
+		{"counts requests", 2, []string{"a", "a", "b"}, 0,
+			map[string]float64{"a": 2, "b": 1}},
+		{"replacement leaves out the inherited count", 2, []string{"a", "a", "a", "b", "c"}, 0,
+			map[string]float64{"a": 3, "c": 1}},
+		{"replaces the smallest count", 2, []string{"a", "b", "b", "b", "c", "c"}, 0,
+			map[string]float64{"b": 3, "c": 2}},
+		{"decays", 1, []string{"a", "a"}, halfLife,
+			map[string]float64{"a": 1}},
+		{"zero capacity", 0, []string{"a"}, 0,
+			map[string]float64{}},
+	}
+	for _, test := range tests {
+		counter := NewHotKeyCounter(test.capacity, halfLife)
+		for _, url := range test.requests {
+			counter.Record(url, start)
+		}
+		got := counter.Top(10, start.Add(test.at))
+		if len(got) != len(test.want) {
+			t.Errorf("%s: Top = %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for _, rate := range got {
+			if want, ok := test.want[rate.URL]; !ok || math.Abs(rate.Rate/lambda-want) > 1e-9 {
+				t.Errorf("%s: %s count = %v, want %v", test.name, rate.URL, rate.Rate/lambda, want)
+			}
+		}
+	}
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"urlnorm"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-// CacheMetrics represents metrics for the cache
+// CacheMetrics represents metrics for the cache. The counters are atomic since
+// hits are counted while holding only the read lock.
 type CacheMetrics struct {
-	Hits         int
-	RequestCount int
+	Hits         atomic.Int64
+	RequestCount atomic.Int64
 }
 
 // CacheEntry represents an entry in the cache
@@ -28,6 +37,8 @@ type CacheEntry struct {
 // Cache represents an in-memory cache
 type Cache struct {
 	entries map[string]CacheEntry
+	// size is the total content size of the entries in bytes
+	size    int
 	mutex   sync.RWMutex
 	metrics CacheMetrics
 }
@@ -36,7 +47,6 @@ type Cache struct {
 func NewCache() *Cache {
 	return &Cache{
 		entries: make(map[string]CacheEntry),
-		metrics: CacheMetrics{0, 0},
 	}
 }
 
@@ -47,8 +57,8 @@ func (c *Cache) Get(key string) (*CacheEntry, bool) {
 	entry, ok := c.entries[key]
 
 	if ok && time.Now().Before(entry.Expiration) {
-		c.metrics.RequestCount++
-		c.metrics.Hits++
+		c.metrics.RequestCount.Add(1)
+		c.metrics.Hits.Add(1)
 		return &entry, true
 	}
 
@@ -59,8 +69,16 @@ func (c *Cache) Get(key string) (*CacheEntry, bool) {
 func (c *Cache) Set(key string, entry CacheEntry) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.size += len(entry.Content) - len(c.entries[key].Content)
 	c.entries[key] = entry
-	c.metrics.RequestCount++
+	c.metrics.RequestCount.Add(1)
+}
+
+// Size returns the number of cached entries and their total content size in bytes
+func (c *Cache) Size() (int, int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries), c.size
 }
 
 // CleanExpiredEntries removes expired cache entries
@@ -76,6 +94,7 @@ func (c *Cache) CleanExpiredEntries() {
 			c.mutex.Lock()
 			// Check expiration time again
 			if entry, ok := c.entries[key]; ok && time.Now().After(entry.Expiration) {
+				c.size -= len(entry.Content)
 				delete(c.entries, key)
 			}
 			c.mutex.Unlock()
@@ -115,9 +134,67 @@ func main() {
 	cache := NewCache()
 
 	httpAddr := flag.String("http", port, "HTTP service address")
+	hotKeyCapacity := flag.Int("hot-key-capacity", 100, "number of most requested URLs counted for /hotkeys")
+	hotKeyHalfLife := flag.Duration("hot-key-half-life", 1600*time.Millisecond, "half-life of the decayed request counts reported on /hotkeys")
+	// Gossip membership, an alternative to sending heartbeats to the main server
+	gossipBind := flag.String("gossip-bind", "", "host:port the gossip listens on (empty disables gossip)")
+	gossipJoin := flag.String("gossip-join", "", "comma-separated gossip addresses of running members to join")
+	gossipKey := flag.String("gossip-key", os.Getenv("GOSSIP_KEY"), "base64 key of 16, 24 or 32 bytes the gossip is encrypted with, required with -gossip-bind (defaults to GOSSIP_KEY)")
+	id := flag.String("id", "", "node ID advertised in the gossip (defaults to -addr)")
+	addr := flag.String("addr", "", "host:port advertised in the gossip (defaults to localhost with the -http port)")
+	replicas := flag.Int("replicas", 1, "number of virtual nodes advertised in the gossip")
+	stripParams := flag.String("url-strip-params", "", "comma-separated query parameters removed from URLs before caching, such as utm_* (should match the router)")
+	flag.Parse()
+
+	var normalizer urlnorm.Normalizer
+	if *stripParams != "" {
+		normalizer = urlnorm.New(strings.Split(*stripParams, ","))
+	}
+
+	hotKeys := NewHotKeyCounter(*hotKeyCapacity, *hotKeyHalfLife)
 
 	fmt.Println("HTTP service listening on ", *httpAddr)
 
+	if *gossipBind != "" {
+		key, err := parseGossipKey(*gossipKey)
+		if err != nil {
+			logger.Fatal("A gossip key is required with -gossip-bind", zap.Error(err))
+		}
+		if *addr == "" {
+			_, port, _ := strings.Cut(*httpAddr, ":")
+			*addr = "localhost:" + port
+		}
+		if *id == "" {
+			*id = *addr
+		}
+		seeds := make([]string, 0)
+		if *gossipJoin != "" {
+			seeds = strings.Split(*gossipJoin, ",")
+		}
+		meta := GossipMeta{Role: gossipRoleCache, Addr: *addr, Replicas: *replicas}
+		gossipLogger, err := zap.NewStdLogAt(logger.Named("gossip"), zapcore.DebugLevel)
+		if err != nil {
+			logger.Fatal("Error creating gossip logger", zap.Error(err))
+		}
+		gossip, err := StartGossip(*id, *gossipBind, seeds, key, meta, gossipLogger)
+		if err != nil {
+			logger.Fatal("Error starting gossip", zap.Error(err))
+		}
+		http.HandleFunc("/gossip/members", gossip.serveMembers())
+
+		// Leave gracefully so observers drop the node at once instead of
+		// waiting for it to fail its probes
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			if err := gossip.Leave(5 * time.Second); err != nil {
+				logger.Error("Error leaving gossip", zap.Error(err))
+			}
+			os.Exit(0)
+		}()
+	}
+
 	// Periodically clean expired cache entries
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour) // Set the interval for cleaning
@@ -131,23 +208,50 @@ func main() {
 		}
 	}()
 
+	// Report that the cache is serving on /healthz, which the main server
+	// probes to catch a dead cache whose heartbeat process is still running
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "ok"}`))
+	})
+
 	// Expose metrics as JSON on /metrics
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		cache.mutex.RLock()
-		defer cache.mutex.RUnlock()
+		entries, size := cache.Size()
 
-		json := []byte(fmt.Sprintf(`{"hits": %d, "requests": %d}`, cache.metrics.Hits, cache.metrics.RequestCount))
+		json := []byte(fmt.Sprintf(`{"hits": %d, "requests": %d, "entries": %d, "bytes": %d}`,
+			cache.metrics.Hits.Load(), cache.metrics.RequestCount.Load(), entries, size))
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(json)
 	})
 
-	// Serve cached or fetched content
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		url := r.URL.Query().Get("url")
-		if url == "" {
-			http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+	// Expose the most requested URLs as JSON on /hotkeys so the main server
+	// can see requests that reach this cache without going through it
+	http.HandleFunc("/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		n := *hotKeyCapacity
+		if value := r.URL.Query().Get("n"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Error parsing n", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"hot_keys": hotKeys.Top(n, time.Now())})
+	})
+
+	// Serve cached or fetched content for url
+	serveURL := func(w http.ResponseWriter, url string) {
+		// Cache and fetch the canonical URL so every spelling of it shares
+		// one entry. The router already sends canonical URLs.
+		url, err := normalizer.Normalize(url)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid URL: %v", err), http.StatusBadRequest)
 			return
 		}
+		hotKeys.Record(url, time.Now())
 
 		if entry, ok := cache.Get(url); ok {
 			// Serve cached content
@@ -183,8 +287,17 @@ func main() {
 		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
 		w.Write(content)
 		logger.Info("Fetched and cached", zap.String("URL", url))
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+			return
+		}
+		serveURL(w, url)
 	})
 
-	fmt.Println("Server started on " + port)
-	http.ListenAndServe(port, nil)
+	fmt.Println("Server started on " + *httpAddr)
+	http.ListenAndServe(*httpAddr, proxyRequests(http.DefaultServeMux, serveURL))
 }
@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// proxyRequests serves the requests of clients using the cache as a standard
+// HTTP forward proxy, whose request line holds the whole URL, with serve and
+// passes every other request to next. It runs before the mux so an origin path
+// like /metrics is not taken for one of the cache's own endpoints.
+func proxyRequests(next http.Handler, serve func(http.ResponseWriter, string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			// A tunnel would carry encrypted traffic that cannot be cached
+			http.Error(w, "CONNECT is not supported, request http:// URLs through the proxy", http.StatusMethodNotAllowed)
+			return
+		}
+		if !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET and HEAD requests can be cached", http.StatusMethodNotAllowed)
+			return
+		}
+		serve(w, r.URL.String())
+	})
+}